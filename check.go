@@ -0,0 +1,293 @@
+package knit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	lua "github.com/zyedidia/gopher-lua"
+	luar "github.com/zyedidia/gopher-luar"
+	"github.com/zyedidia/knit/rules"
+)
+
+// A probe is a test program that is compiled to check whether the compiler
+// and system support a feature.
+type probe struct {
+	cc      string // compiler command
+	cflags  string
+	ldflags string
+	link    bool // link the program in addition to compiling it
+	source  string
+}
+
+// Options that may be given to checks in a table.
+type checkOpts struct {
+	cc      string
+	cflags  string
+	ldflags string
+	define  string
+	link    bool
+}
+
+// A define recorded by a check, to be written into a configuration header.
+type define struct {
+	name  string
+	value string // empty if the define is not set
+}
+
+// Returns the 'knit.check' module.
+func (vm *LuaVM) pkgcheck() *lua.LTable {
+	pkg := vm.L.NewTable()
+
+	vm.L.SetField(pkg, "has_header", vm.checkFunc(func(header string, opts checkOpts) (bool, error) {
+		ok, err := vm.runProbe(opts.probe(vm, fmt.Sprintf("#include <%s>\nint main(void) { return 0; }\n", header)))
+		vm.define(opts.define, "HAVE_"+header, ok)
+		return ok, err
+	}))
+	vm.L.SetField(pkg, "has_function", vm.checkFunc(func(fn string, opts checkOpts) (bool, error) {
+		// declare the function without its header, so that only linking
+		// determines whether it exists
+		opts.link = true
+		ok, err := vm.runProbe(opts.probe(vm, fmt.Sprintf("char %s(void);\nint main(void) { return %s(); }\n", fn, fn)))
+		vm.define(opts.define, "HAVE_"+fn, ok)
+		return ok, err
+	}))
+	vm.L.SetField(pkg, "compiler_accepts_flag", vm.checkFunc(func(flag string, opts checkOpts) (bool, error) {
+		// make the compiler fail for flags that it only warns about
+		opts.cflags = strings.TrimSpace(opts.cflags + " -Werror " + flag)
+		ok, err := vm.runProbe(opts.probe(vm, "int main(void) { return 0; }\n"))
+		if opts.define != "" {
+			vm.define(opts.define, "", ok)
+		}
+		return ok, err
+	}))
+	vm.L.SetField(pkg, "try_compile", vm.checkFunc(func(source string, opts checkOpts) (bool, error) {
+		ok, err := vm.runProbe(opts.probe(vm, source))
+		if opts.define != "" {
+			vm.define(opts.define, "", ok)
+		}
+		return ok, err
+	}))
+	vm.L.SetField(pkg, "define", luar.New(vm.L, func(name string, value lua.LValue) {
+		switch v := value.(type) {
+		case *lua.LNilType:
+			vm.define(name, "", false)
+		case lua.LBool:
+			vm.define(name, "", bool(v))
+		default:
+			vm.defines = append(vm.defines, define{name: name, value: LToString(v)})
+		}
+	}))
+	vm.L.SetField(pkg, "config_h", luar.New(vm.L, func(path string) LRule {
+		spec, err := vm.configRule(path)
+		if err != nil {
+			vm.Err(err)
+		}
+		return LRule{
+			File: spec.File,
+			Line: spec.Line,
+			Spec: &spec,
+		}
+	}))
+	return pkg
+}
+
+// Wraps a check so that it can be called from Lua with a subject and an
+// optional table of options.
+func (vm *LuaVM) checkFunc(check func(subject string, opts checkOpts) (bool, error)) *lua.LFunction {
+	return vm.L.NewFunction(func(L *lua.LState) int {
+		subject := L.CheckString(1)
+		var opts checkOpts
+		if tbl, ok := L.Get(2).(*lua.LTable); ok {
+			var err error
+			opts, err = checkOptions(tbl)
+			if err != nil {
+				vm.Err(err)
+			}
+		}
+		ok, err := check(subject, opts)
+		if err != nil {
+			vm.Err(err)
+		}
+		L.Push(lua.LBool(ok))
+		return 1
+	})
+}
+
+func checkOptions(tbl *lua.LTable) (checkOpts, error) {
+	var opts checkOpts
+	var err error
+	tbl.ForEach(func(k, v lua.LValue) {
+		switch LToString(k) {
+		case "cc":
+			opts.cc = LToString(v)
+		case "cflags":
+			opts.cflags = LToString(v)
+		case "ldflags":
+			opts.ldflags = LToString(v)
+		case "define":
+			opts.define = LToString(v)
+		case "link":
+			opts.link = lua.LVAsBool(v)
+		default:
+			err = fmt.Errorf("check: unknown option '%s'", LToString(k))
+		}
+	})
+	return opts, err
+}
+
+// Creates the probe for 'source' with these options. The compiler is $CC, or
+// 'cc' if it is not set.
+func (o checkOpts) probe(vm *LuaVM, source string) probe {
+	cc := o.cc
+	if cc == "" {
+		if env, ok := vm.currentEnviron()["CC"]; ok && env != "" {
+			cc = env
+		} else {
+			cc = "cc"
+		}
+	}
+	return probe{
+		cc:      cc,
+		cflags:  o.cflags,
+		ldflags: o.ldflags,
+		link:    o.link,
+		source:  source,
+	}
+}
+
+// Records the result of a check as a define. If 'name' is empty 'def' is used,
+// converted to an identifier (HAVE_STDIO_H for stdio.h).
+func (vm *LuaVM) define(name, def string, ok bool) {
+	if name == "" {
+		name = strings.ToUpper(strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, def))
+	}
+	d := define{name: name}
+	if ok {
+		d.value = "1"
+	}
+	vm.defines = append(vm.defines, d)
+}
+
+// Returns a hash that identifies the result of the probe: the compiler's
+// fingerprint, its flags, and the test program.
+func (vm *LuaVM) probeHash(p probe) (uint64, error) {
+	tool := strings.Fields(p.cc)
+	if len(tool) == 0 {
+		return 0, fmt.Errorf("check: no compiler")
+	}
+	fp, ok, err := vm.Fingerprint(tool[0])
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		fp, err = binaryFingerprint(tool[0], vm.currentEnviron()["PATH"])
+		if err != nil {
+			return 0, err
+		}
+	}
+	h := fnv1a.HashString64(fp)
+	h = fnv1a.AddString64(h, p.cc)
+	h = fnv1a.AddString64(h, p.cflags)
+	h = fnv1a.AddString64(h, p.ldflags)
+	h = fnv1a.AddString64(h, fmt.Sprint(p.link))
+	return fnv1a.AddString64(h, p.source), nil
+}
+
+// Compiles the probe in a temporary directory, and returns true if it
+// succeeded. Results are cached in the database.
+func (vm *LuaVM) runProbe(p probe) (bool, error) {
+	h, err := vm.probeHash(p)
+	if err != nil {
+		return false, err
+	}
+	if vm.db != nil {
+		if ok, found := vm.db.Checks[h]; found {
+			return ok, nil
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "knit-check")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, "conftest.c"), []byte(p.source), 0666); err != nil {
+		return false, err
+	}
+	var cmd string
+	if p.link {
+		cmd = fmt.Sprintf("%s %s conftest.c -o conftest %s", p.cc, p.cflags, p.ldflags)
+	} else {
+		cmd = fmt.Sprintf("%s %s -c conftest.c -o conftest.o", p.cc, p.cflags)
+	}
+	c := exec.Command(vm.shell, "-c", cmd)
+	c.Dir = dir
+	c.Env = envList(vm.currentEnviron())
+	ok := c.Run() == nil
+
+	if vm.db != nil {
+		vm.db.Checks[h] = ok
+	}
+	return ok, nil
+}
+
+// Returns a rule that writes the defines recorded so far to the header 'path'.
+func (vm *LuaVM) configRule(path string) (rules.RuleSpec, error) {
+	buf := &strings.Builder{}
+	buf.WriteString("/* generated by knit */\n")
+	for _, d := range vm.defines {
+		if d.value == "" {
+			fmt.Fprintf(buf, "/* #undef %s */\n", d.name)
+		} else {
+			fmt.Fprintf(buf, "#define %s %s\n", d.name, d.value)
+		}
+	}
+
+	// the recipe is a Lua function so that the contents do not need to be
+	// escaped for the shell
+	if err := vm.L.DoString(`return function(text) return function()
+		os.remove(output)
+		local f = assert(io.open(output, "w"))
+		f:write(text)
+		f:close()
+	end end`); err != nil {
+		return rules.RuleSpec{}, err
+	}
+	mk := vm.L.Get(-1)
+	vm.L.Pop(1)
+	if err := vm.L.CallByParam(lua.P{
+		Fn:      mk,
+		NRet:    1,
+		Protect: true,
+	}, lua.LString(buf.String())); err != nil {
+		return rules.RuleSpec{}, err
+	}
+	fn := vm.L.Get(-1).(*lua.LFunction)
+	vm.L.Pop(1)
+
+	recipe, err := newLuaRecipe(fn)
+	if err != nil {
+		return rules.RuleSpec{}, err
+	}
+	spec := rules.RuleSpec{
+		Targets: []string{path},
+		Func:    recipe,
+	}
+	if dbg, ok := vm.L.GetStack(1); ok {
+		vm.L.GetInfo("nSl", dbg, nil)
+		spec.File = dbg.Source
+		spec.Line = dbg.CurrentLine
+		// describe the recipe by where the header was declared
+		recipe.file, recipe.line = spec.File, spec.Line
+	}
+	return spec, nil
+}
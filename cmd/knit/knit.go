@@ -91,6 +91,11 @@ func main() {
 	hash := optBool(main, "hash", "", true, user.Hash, "hash files to determine if they are out-of-date")
 	updated := optStringSlice(main, "updated", "u", nil, user.Updated, "treat files as updated")
 	keep := optBool(main, "keep-going", "", false, user.KeepGoing, "keep going even if recipes fail")
+	showRecipes := optBool(main, "show-recipe-changes", "", false, user.ShowRecipeChanges, "show how a recipe changed before re-running it")
+	hermetic := optBool(main, "hermetic", "", false, user.Hermetic, "run recipes with a minimal environment and no stdin")
+	verify := optBool(main, "verify-outputs", "", false, user.VerifyOutputs, "fail if a recipe does not create all of its outputs")
+	inproc := optBool(main, "in-process", "", false, user.InProcess, "run recipes with the internal shell instead of starting a shell process")
+	strict := optBool(main, "strict", "", false, user.Strict, "warn about targets that several rules could build")
 
 	path, err := exec.LookPath("sh")
 	if err != nil {
@@ -162,20 +167,25 @@ func main() {
 
 	out := os.Stdout
 	file, err := knit.Run(out, main.Args(), knit.Flags{
-		Knitfile:  *knitfile,
-		Ncpu:      *ncpu,
-		DryRun:    *dryrun,
-		RunDir:    *rundir,
-		Always:    *always,
-		Quiet:     *quiet,
-		Style:     *style,
-		CacheDir:  *cache,
-		Hash:      *hash,
-		Updated:   *updated,
-		KeepGoing: *keep,
-		Shell:     *shellf,
-		Tool:      *tool,
-		ToolArgs:  toolargs,
+		Knitfile:          *knitfile,
+		Ncpu:              *ncpu,
+		DryRun:            *dryrun,
+		RunDir:            *rundir,
+		Always:            *always,
+		Quiet:             *quiet,
+		Style:             *style,
+		CacheDir:          *cache,
+		Hash:              *hash,
+		Updated:           *updated,
+		KeepGoing:         *keep,
+		Shell:             *shellf,
+		Tool:              *tool,
+		ToolArgs:          toolargs,
+		ShowRecipeChanges: *showRecipes,
+		Hermetic:          *hermetic,
+		VerifyOutputs:     *verify,
+		InProcess:         *inproc,
+		Strict:            *strict,
 	})
 
 	rel, rerr := filepath.Rel(file, wd)
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -18,36 +19,46 @@ import (
 
 // Flags for modifying the behavior of Knit.
 type Flags struct {
-	Knitfile  string
-	Ncpu      int
-	DryRun    bool
-	RunDir    string
-	Always    bool
-	Quiet     bool
-	Style     string
-	CacheDir  string
-	Hash      bool
-	Updated   []string
-	Shell     string
-	KeepGoing bool
-	Tool      string
-	ToolArgs  []string
+	Knitfile          string
+	Ncpu              int
+	DryRun            bool
+	RunDir            string
+	Always            bool
+	Quiet             bool
+	Style             string
+	CacheDir          string
+	Hash              bool
+	Updated           []string
+	Shell             string
+	KeepGoing         bool
+	Tool              string
+	ToolArgs          []string
+	ShowRecipeChanges bool
+	Hermetic          bool
+	VerifyOutputs     bool
+	InProcess         bool
+	Strict            bool
 }
 
 // Flags that may be automatically set in a .knit.toml file.
 type UserFlags struct {
-	Knitfile  *string
-	Ncpu      *int
-	DryRun    *bool
-	RunDir    *string `toml:"directory"`
-	Always    *bool
-	Quiet     *bool
-	Style     *string
-	CacheDir  *string `toml:"cache"`
-	Hash      *bool
-	Updated   *[]string
-	Shell     *string
-	KeepGoing *bool
+	Knitfile          *string
+	Ncpu              *int
+	DryRun            *bool
+	RunDir            *string `toml:"directory"`
+	Always            *bool
+	Quiet             *bool
+	Style             *string
+	CacheDir          *string `toml:"cache"`
+	Hash              *bool
+	Updated           *[]string
+	Shell             *string
+	KeepGoing         *bool
+	ShowRecipeChanges *bool
+	Hermetic          *bool
+	VerifyOutputs     *bool
+	InProcess         *bool
+	Strict            *bool
 }
 
 // Capitalize the first rune of a string.
@@ -150,20 +161,6 @@ func getBuildSets(lval lua.LValue) (map[string]*LBuildSet, error) {
 		},
 	}
 
-	var addBuildSet func(bs LBuildSet)
-	addBuildSet = func(bs LBuildSet) {
-		if b, ok := bsets[bs.Dir]; ok {
-			b.rset = append(b.rset, bs.rset...)
-		} else {
-			bsets[bs.Dir] = &bs
-		}
-
-		// TODO: can there be a buildset cycle?
-		for _, bset := range bs.bsets {
-			addBuildSet(bset)
-		}
-	}
-
 	switch v := lval.(type) {
 	case lua.LString:
 		return nil, &ErrMessage{msg: string(v)}
@@ -172,7 +169,7 @@ func getBuildSets(lval lua.LValue) (map[string]*LBuildSet, error) {
 	case *lua.LUserData:
 		switch u := v.Value.(type) {
 		case LBuildSet:
-			addBuildSet(u)
+			addBuildSet(bsets, u)
 		default:
 			return nil, fmt.Errorf("invalid return value: %v", lval)
 		}
@@ -182,72 +179,59 @@ func getBuildSets(lval lua.LValue) (map[string]*LBuildSet, error) {
 	return bsets, nil
 }
 
-// Run searches for a Knitfile and executes it, according to args (a list of
-// targets and assignments), and the flags. All output is written to 'out'. The
-// path of the executed knitfile is returned, along with a possible error.
-func Run(out io.Writer, args []string, flags Flags) (string, error) {
-	if flags.RunDir != "" {
-		err := os.Chdir(flags.RunDir)
-		if err != nil {
-			return "", err
-		}
-	}
-
-	vm := NewLuaVM(flags.Shell, flags)
-
-	cliAssigns, targets := makeAssigns(args)
-	envAssigns, _ := makeAssigns(os.Environ())
-
-	vm.MakeTable("cli", cliAssigns)
-	vm.MakeTable("env", envAssigns)
-
-	file, dir, err := FindBuildFile(flags.Knitfile)
-	if err != nil {
-		return "", err
-	}
-	knitpath := filepath.Join(dir, file)
-	if file == "" {
-		def, ok := DefaultBuildFile()
-		if ok {
-			file = def
-		}
-	} else if dir != "" {
-		for i, u := range flags.Updated {
-			p, err := rel(dir, u)
-			if err != nil {
-				return knitpath, err
-			}
-			flags.Updated[i] = p
-		}
-		err = goToKnitfile(vm, dir, targets)
-		if err != nil {
-			return knitpath, err
+// Adds the rules of 'bs' and its sub-buildsets to 'bsets'.
+func addBuildSet(bsets map[string]*LBuildSet, bs LBuildSet) {
+	if b, ok := bsets[bs.Dir]; ok {
+		b.rset = append(b.rset, bs.rset...)
+		if b.BuildDir == "" {
+			b.BuildDir = bs.BuildDir
 		}
+	} else {
+		bsets[bs.Dir] = &bs
 	}
 
-	if file == "" {
-		return knitpath, fmt.Errorf("%s does not exist", flags.Knitfile)
-	}
-
-	lval, err := vm.DoFile(file)
-	if err != nil {
-		return knitpath, err
+	// TODO: can there be a buildset cycle?
+	for _, bset := range bs.bsets {
+		addBuildSet(bsets, bset)
 	}
+}
 
-	bsets, err := getBuildSets(lval)
-	if err != nil {
-		return knitpath, err
-	}
+// Tools that inspect the rules rather than the graph of the requested targets.
+// They run even if the requested targets cannot be resolved, since they are
+// used to find out why.
+var rulesTools = map[string]bool{
+	"resolve": true,
+	"lint":    true,
+}
 
+// Parses the rules in 'bsets' and merges them into one rule set.
+func ruleSet(bsets map[string]*LBuildSet) (*rules.RuleSet, error) {
 	var rulesets []*rules.RuleSet
 	var main *rules.RuleSet
+	// locations of the rules that expanded each variable from Lua
+	expanded := make(map[string]string)
 
 	for k, v := range bsets {
 		rs := rules.NewRuleSet(k)
+		if v.BuildDir != "" {
+			if err := rs.SetBuildDir(v.BuildDir); err != nil {
+				return nil, err
+			}
+		}
 		for _, lr := range v.rset {
-			err := rules.ParseInto(lr.Contents, rs, lr.File, lr.Line)
+			var err error
+			if lr.Spec != nil {
+				err = rs.AddSpec(*lr.Spec)
+			} else {
+				err = rules.ParseInto(lr.Contents, rs, lr.File, lr.Line)
+			}
+			for _, name := range lr.expanded {
+				if _, ok := expanded[name]; !ok {
+					expanded[name] = fmt.Sprintf("%s:%d", lr.File, lr.Line)
+				}
+			}
 			if err != nil {
-				return knitpath, err
+				return nil, err
 			}
 		}
 		if k == "." {
@@ -258,10 +242,27 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 	}
 
 	if main == nil {
-		return knitpath, fmt.Errorf("no buildset for the root directory found")
+		return nil, fmt.Errorf("no buildset for the root directory found")
 	}
 
 	rs := rules.MergeRuleSets(main, rulesets)
+	if err := rs.CheckExpanded(expanded); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Creates the build graph for 'targets' from the rules in 'bsets', and expands
+// its recipes. If no targets are given, the main target is built. The targets
+// of the graph are returned with it. If the targets cannot be resolved or
+// expanded, a graph of just the rules is returned with the error (see
+// rulesTools). If 'strict' is set, the graph records
+// warnings about ambiguous rules.
+func buildGraph(vm *LuaVM, bsets map[string]*LBuildSet, targets []string, updated map[string]bool, strict bool) (*rules.Graph, []string, error) {
+	rs, err := ruleSet(bsets)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	alltargets := rs.AllTargets()
 
@@ -271,7 +272,7 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 	rootTargets := make([]string, 0, len(targets))
 
 	if len(targets) == 0 {
-		return knitpath, errors.New("no targets")
+		return nil, nil, errors.New("no targets")
 	}
 
 	for _, t := range targets {
@@ -298,23 +299,166 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		Rebuild: true,
 	}))
 
-	updated := make(map[string]bool)
-	for _, u := range flags.Updated {
-		updated[u] = true
-	}
-
-	graph, err := rules.NewGraph(rs, ":build", updated)
+	graph, err := rules.NewGraph(rs, ":build", updated, strict)
 	if err != nil {
-		g, rerr := rules.NewGraph(rs, ":build-root", updated)
+		g, rerr := rules.NewGraph(rs, ":build-root", updated, strict)
 		if rerr != nil {
-			return knitpath, err
+			return rules.RulesGraph(rs, vm, updated), nil, err
 		}
 		graph = g
 	}
 
 	err = graph.ExpandRecipes(vm)
 	if err != nil {
-		return knitpath, err
+		return rules.RulesGraph(rs, vm, updated), nil, err
+	}
+	return graph, targets, nil
+}
+
+// Creates the build graph for 'targets' like buildGraph, after running the
+// graph hooks, which see the graph of all targets and may add rules before the
+// graph for the requested targets is created. The graph of all targets is
+// only created if a hook uses it.
+func knitGraph(vm *LuaVM, bsets map[string]*LBuildSet, targets []string, updated map[string]bool, db *rules.Database, flags Flags) (*rules.Graph, []string, error) {
+	if len(vm.graphHooks) != 0 {
+		rs, err := ruleSet(bsets)
+		if err != nil {
+			return nil, nil, err
+		}
+		var view *rules.GraphView
+		added, err := vm.RunGraphHooks(func() *rules.GraphView {
+			if view == nil {
+				view = rules.AllGraph(rs, vm, updated).View(db, flags.Hash)
+			}
+			return view
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, bs := range added {
+			addBuildSet(bsets, bs)
+		}
+	}
+	return buildGraph(vm, bsets, targets, updated, flags.Strict)
+}
+
+// Splits 'targets' into the targets of the default build, and the targets of
+// each variant, which are written as 'target@variant'. A variant with no
+// target before the '@' builds its main target.
+func splitVariants(targets []string, variants []variant) ([]string, map[string][]string) {
+	deftargets := make([]string, 0, len(targets))
+	vtargets := make(map[string][]string)
+	for _, t := range targets {
+		i := strings.LastIndexByte(t, '@')
+		found := false
+		for _, v := range variants {
+			found = found || (i != -1 && t[i+1:] == v.name)
+		}
+		if !found {
+			deftargets = append(deftargets, t)
+			continue
+		}
+		name := t[i+1:]
+		if target := t[:i]; target != "" && !strings.HasSuffix(target, "/") {
+			vtargets[name] = append(vtargets[name], target)
+		} else if _, ok := vtargets[name]; !ok {
+			vtargets[name] = nil
+		}
+	}
+	return deftargets, vtargets
+}
+
+// Returns an error if the Knitfile evaluated by 'vm' declares options, and one
+// of 'assigns' does not set an option.
+func checkAssigns(vm *LuaVM, assigns []assign) error {
+	opts := vm.Options()
+	if len(opts) == 0 {
+		return nil
+	}
+	for _, a := range assigns {
+		found := false
+		for _, o := range opts {
+			found = found || o.Name == a.name
+		}
+		if !found {
+			return fmt.Errorf("unknown option '%s' (use '-t options' to list the options)", a.name)
+		}
+	}
+	return nil
+}
+
+// Evaluates the Knitfile 'file' again for the variant 'v', in a new VM, and
+// creates the graph for 'targets'.
+func variantGraph(v variant, file string, cliAssigns, envAssigns []assign, flags Flags, db *rules.Database, targets []string, updated map[string]bool) (*rules.Graph, error) {
+	vm := NewLuaVM(flags.Shell, flags)
+	// the variant's assignments override those on the command line
+	assigns := append(append([]assign(nil), cliAssigns...), v.vars...)
+	vm.MakeTable("cli", assigns)
+	vm.MakeTable("env", envAssigns)
+	vm.L.SetGlobal("variant", lua.LString(v.name))
+	vm.db = db
+
+	lval, err := vm.DoFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAssigns(vm, assigns); err != nil {
+		return nil, err
+	}
+	bsets, err := getBuildSets(lval)
+	if err != nil {
+		return nil, err
+	}
+	g, _, err := knitGraph(vm, bsets, targets, updated, db, flags)
+	return g, err
+}
+
+// Run searches for a Knitfile and executes it, according to args (a list of
+// targets and assignments), and the flags. All output is written to 'out'. The
+// path of the executed knitfile is returned, along with a possible error.
+func Run(out io.Writer, args []string, flags Flags) (string, error) {
+	if flags.RunDir != "" {
+		err := os.Chdir(flags.RunDir)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	vm := NewLuaVM(flags.Shell, flags)
+
+	cliAssigns, targets := makeAssigns(args)
+	envAssigns, _ := makeAssigns(os.Environ())
+
+	vm.MakeTable("cli", cliAssigns)
+	vm.MakeTable("env", envAssigns)
+	vm.L.SetGlobal("variant", lua.LString(""))
+
+	file, dir, err := FindBuildFile(flags.Knitfile)
+	if err != nil {
+		return "", err
+	}
+	knitpath := filepath.Join(dir, file)
+	if file == "" {
+		def, ok := DefaultBuildFile()
+		if ok {
+			file = def
+		}
+	} else if dir != "" {
+		for i, u := range flags.Updated {
+			p, err := rel(dir, u)
+			if err != nil {
+				return knitpath, err
+			}
+			flags.Updated[i] = p
+		}
+		err = goToKnitfile(vm, dir, targets)
+		if err != nil {
+			return knitpath, err
+		}
+	}
+
+	if file == "" {
+		return knitpath, fmt.Errorf("%s does not exist", flags.Knitfile)
 	}
 
 	var db *rules.Database
@@ -331,12 +475,66 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		}
 		db = rules.NewCacheDatabase(dir, filepath.Join(wd, file))
 	}
+	// checks in the Knitfile cache their results in the database
+	vm.db = db
+
+	lval, err := vm.DoFile(file)
+	if err != nil {
+		return knitpath, err
+	}
+
+	if err := checkAssigns(vm, cliAssigns); err != nil {
+		return knitpath, err
+	}
+
+	bsets, err := getBuildSets(lval)
+	if err != nil {
+		return knitpath, err
+	}
+
+	updated := make(map[string]bool)
+	for _, u := range flags.Updated {
+		updated[u] = true
+	}
+
+	deftargets, vtargets := splitVariants(targets, vm.variants)
+	var graphs []*rules.Graph
+	var names []string
+	if len(deftargets) != 0 || len(vtargets) == 0 {
+		g, built, err := knitGraph(vm, bsets, deftargets, updated, db, flags)
+		if err != nil && (g == nil || !rulesTools[flags.Tool]) {
+			return knitpath, err
+		}
+		graphs = append(graphs, g)
+		names = append(names, "the default build")
+		if len(vtargets) == 0 {
+			targets = built
+		}
+	}
+	for _, v := range vm.variants {
+		if vts, ok := vtargets[v.name]; ok {
+			g, err := variantGraph(v, file, cliAssigns, envAssigns, flags, db, vts, updated)
+			if err != nil {
+				return knitpath, fmt.Errorf("variant '%s': %w", v.name, err)
+			}
+			graphs = append(graphs, g)
+			names = append(names, fmt.Sprintf("variant '%s'", v.name))
+		}
+	}
+	graph, err := rules.JoinGraphs(graphs, names)
+	if err != nil {
+		return knitpath, err
+	}
 
 	var w io.Writer = out
 	if flags.Quiet {
 		w = io.Discard
 	}
 
+	for _, warning := range graph.Warnings() {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+
 	if flags.Tool != "" {
 		var t rules.Tool
 		switch flags.Tool {
@@ -358,6 +556,14 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 			t = &rules.PathTool{W: w, Path: knitpath}
 		case "db":
 			t = &rules.DbTool{W: w, Db: db}
+		case "recipe-diff":
+			t = &rules.RecipeDiffTool{W: w, Db: db}
+		case "resolve":
+			t = &rules.ResolveTool{W: w}
+		case "lint":
+			t = &rules.LintTool{W: w}
+		case "options":
+			t = &rules.OptionsTool{W: w, Options: vm.Options()}
 		default:
 			return knitpath, fmt.Errorf("unknown tool: %s", flags.Tool)
 		}
@@ -387,28 +593,81 @@ func Run(out io.Writer, args []string, flags Flags) (string, error) {
 		printer = &BasicPrinter{w: w}
 	}
 
+	// Lua hooks are called from this goroutine, since the VM is not safe for
+	// concurrent use. Errors from node hooks are reported after the build.
+	var hookErr error
+	var onNode func(ev rules.NodeEvent)
+	if vm.HasHooks("node") {
+		onNode = func(ev rules.NodeEvent) {
+			if hookErr != nil {
+				return
+			}
+			fields := map[string]lua.LValue{
+				"name":     lua.LString(ev.Name),
+				"targets":  GoStrSliceToTable(vm.L, ev.Targets),
+				"ok":       lua.LBool(ev.Err == nil),
+				"duration": lua.LNumber(ev.Duration.Seconds()),
+			}
+			if ev.Err != nil {
+				fields["error"] = lua.LString(ev.Err.Error())
+			}
+			hookErr = vm.RunHooks("node", fields)
+		}
+	}
+
 	lock := sync.Mutex{}
 	ex := rules.NewExecutor(".", db, flags.Ncpu, printer, func(msg string) {
 		lock.Lock()
 		fmt.Fprintln(out, msg)
 		lock.Unlock()
 	}, rules.Options{
-		NoExec:       flags.DryRun,
-		Shell:        flags.Shell,
-		AbortOnError: !flags.KeepGoing,
-		BuildAll:     flags.Always,
-		Hash:         flags.Hash,
+		NoExec:            flags.DryRun,
+		Shell:             flags.Shell,
+		AbortOnError:      !flags.KeepGoing,
+		BuildAll:          flags.Always,
+		Hash:              flags.Hash,
+		ShowRecipeChanges: flags.ShowRecipeChanges,
+		Hermetic:          flags.Hermetic,
+		Env:               vm.Environ(),
+		VerifyOutputs:     flags.VerifyOutputs,
+		InProcess:         flags.InProcess,
+		OnNode:            onNode,
 	})
 
+	start := time.Now()
+	err = vm.RunHooks("start", map[string]lua.LValue{
+		"targets": GoStrSliceToTable(vm.L, targets),
+	})
+	if err != nil {
+		return knitpath, err
+	}
+
 	rebuilt, execerr := ex.Exec(graph)
 
 	err = db.Save()
 	if err != nil {
 		return knitpath, err
 	}
+
+	fields := map[string]lua.LValue{
+		"targets":  GoStrSliceToTable(vm.L, targets),
+		"ok":       lua.LBool(execerr == nil),
+		"rebuilt":  lua.LBool(rebuilt),
+		"duration": lua.LNumber(time.Since(start).Seconds()),
+	}
+	if execerr != nil {
+		fields["error"] = lua.LString(execerr.Error())
+	}
+	if err := vm.RunHooks("finish", fields); err != nil && hookErr == nil {
+		hookErr = err
+	}
+
 	if execerr != nil {
 		return knitpath, execerr
 	}
+	if hookErr != nil {
+		return knitpath, hookErr
+	}
 	if !rebuilt {
 		return knitpath, fmt.Errorf("'%s': %w", strings.Join(targets, " "), ErrNothingToDo)
 	}
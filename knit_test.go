@@ -26,6 +26,34 @@ type Build struct {
 	Output   string
 	Notbuilt []string
 	Error    string
+	// if set, this tool is run instead of the test's tool
+	Tool     string
+	Toolargs []string
+	// environment variables that are set during this build
+	Env map[string]string
+}
+
+// Sets the environment variables 'env', and returns a function that restores
+// their previous values.
+func setenv(env map[string]string) func() {
+	prev := make(map[string]*string)
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			prev[k] = &old
+		} else {
+			prev[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range prev {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
 }
 
 func exists(path string) bool {
@@ -63,7 +91,14 @@ func runTest(dir string, t *testing.T) {
 	defer os.Chdir(wd)
 	for i, b := range test.Builds {
 		buf := &bytes.Buffer{}
-		_, err := knit.Run(buf, b.Args, test.Flags)
+		flags := test.Flags
+		if b.Tool != "" {
+			flags.Tool = b.Tool
+			flags.ToolArgs = b.Toolargs
+		}
+		restore := setenv(b.Env)
+		_, err := knit.Run(buf, b.Args, flags)
+		restore()
 		if err != nil {
 			if err.Error() == b.Error {
 				continue
@@ -0,0 +1,40 @@
+package knit
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+
+	lua "github.com/zyedidia/gopher-lua"
+)
+
+// The built-in Lua modules, available as 'knit.<name>'.
+//
+//go:embed lib/*.knit
+var lib embed.FS
+
+// Adds a loader for the built-in modules to 'package.loaders'. It is searched
+// after 'package.path', so a module on the path (such as one added with
+// 'knit.addpath') overrides the built-in module of the same name.
+func (vm *LuaVM) openLib() {
+	loaders, ok := vm.L.GetField(vm.L.GetField(vm.L.Get(lua.EnvironIndex), "package"), "loaders").(*lua.LTable)
+	if !ok {
+		panic("package.loaders must be a table")
+	}
+	loaders.Append(vm.L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		file := "lib/" + strings.TrimPrefix(name, "knit.") + ".knit"
+		data, err := lib.ReadFile(file)
+		if !strings.HasPrefix(name, "knit.") || err != nil {
+			L.Push(lua.LString(fmt.Sprintf("no built-in module '%s'", name)))
+			return 1
+		}
+		fn, err := L.Load(bytes.NewReader(data), name)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(fn)
+		return 1
+	}))
+}
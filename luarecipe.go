@@ -0,0 +1,226 @@
+package knit
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/segmentio/fasthash/fnv1a"
+	lua "github.com/zyedidia/gopher-lua"
+	"github.com/zyedidia/knit/rules"
+)
+
+// A LuaRecipe is a recipe implemented by a Lua function. Lua states are not
+// thread-safe, so the function and the values it captures are copied when the
+// rule is created, and recreated in a new state every time the recipe runs.
+type LuaRecipe struct {
+	fn   *frozenFunc
+	hash uint64
+	file string
+	line int
+}
+
+// A frozen Lua value that can be recreated in another Lua state. Frozen values
+// are either immutable Lua values (nil, booleans, numbers, and strings),
+// *frozenTable, *frozenFunc, or unavailable.
+type frozen interface{}
+
+// A value that cannot be copied to another Lua state, such as a Go function or
+// userdata. It is recreated as nil.
+type unavailable struct {
+	typ lua.LValueType
+}
+
+type frozenTable struct {
+	keys []frozen
+	vals []frozen
+}
+
+// Tables are sorted by key so that they are always traversed in the same order.
+func (t *frozenTable) Len() int { return len(t.keys) }
+func (t *frozenTable) Less(i, j int) bool {
+	return frozenKey(t.keys[i]) < frozenKey(t.keys[j])
+}
+func (t *frozenTable) Swap(i, j int) {
+	t.keys[i], t.keys[j] = t.keys[j], t.keys[i]
+	t.vals[i], t.vals[j] = t.vals[j], t.vals[i]
+}
+
+func frozenKey(f frozen) string {
+	if v, ok := f.(lua.LValue); ok {
+		return v.Type().String() + ":" + v.String()
+	}
+	return ""
+}
+
+type frozenFunc struct {
+	proto    *lua.FunctionProto
+	upvalues []frozen
+}
+
+// Creates a recipe from a Lua function.
+func newLuaRecipe(fn *lua.LFunction) (*LuaRecipe, error) {
+	if fn.IsG {
+		return nil, fmt.Errorf("recipe must be a Lua function")
+	}
+	f := freeze(fn, make(map[lua.LValue]frozen))
+	return &LuaRecipe{
+		fn:   f.(*frozenFunc),
+		hash: hashFrozen(fnv1a.Init64, f, make(map[frozen]int)),
+		file: fn.Proto.SourceName,
+		line: fn.Proto.LineDefined,
+	}, nil
+}
+
+// Copies 'v' so that it can be recreated in another state. The 'seen' map
+// preserves the identity of tables and functions, including cycles.
+func freeze(v lua.LValue, seen map[lua.LValue]frozen) frozen {
+	if f, ok := seen[v]; ok {
+		return f
+	}
+	switch v := v.(type) {
+	case *lua.LNilType, lua.LBool, lua.LNumber, lua.LString:
+		return v
+	case *lua.LTable:
+		t := &frozenTable{}
+		seen[v] = t
+		v.ForEach(func(key, val lua.LValue) {
+			t.keys = append(t.keys, freeze(key, seen))
+			t.vals = append(t.vals, freeze(val, seen))
+		})
+		sort.Stable(t)
+		return t
+	case *lua.LFunction:
+		if v.IsG {
+			break
+		}
+		f := &frozenFunc{
+			proto:    v.Proto,
+			upvalues: make([]frozen, len(v.Upvalues)),
+		}
+		seen[v] = f
+		for i, uv := range v.Upvalues {
+			var val lua.LValue = lua.LNil
+			if uv != nil {
+				val = uv.Value()
+			}
+			f.upvalues[i] = freeze(val, seen)
+		}
+		return f
+	}
+	return unavailable{v.Type()}
+}
+
+// Recreates a frozen value in the state L.
+func thaw(L *lua.LState, f frozen, made map[frozen]lua.LValue) lua.LValue {
+	if v, ok := made[f]; ok {
+		return v
+	}
+	switch f := f.(type) {
+	case *frozenTable:
+		t := L.NewTable()
+		made[f] = t
+		for i := range f.keys {
+			t.RawSet(thaw(L, f.keys[i], made), thaw(L, f.vals[i], made))
+		}
+		return t
+	case *frozenFunc:
+		fn := L.NewFunctionFromProto(f.proto)
+		made[f] = fn
+		for i, uv := range f.upvalues {
+			fn.Upvalues[i] = &lua.Upvalue{}
+			fn.Upvalues[i].SetValue(thaw(L, uv, made))
+		}
+		return fn
+	case unavailable:
+		return lua.LNil
+	}
+	return f.(lua.LValue)
+}
+
+// Hashes a frozen value. Functions are hashed by their bytecode, so that moving
+// a function within a file does not change its hash.
+func hashFrozen(h uint64, f frozen, seen map[frozen]int) uint64 {
+	if id, ok := seen[f]; ok {
+		return fnv1a.AddUint64(h, uint64(id))
+	}
+	switch f := f.(type) {
+	case *frozenTable:
+		seen[f] = len(seen)
+		h = fnv1a.AddString64(h, "table")
+		for i := range f.keys {
+			h = hashFrozen(h, f.keys[i], seen)
+			h = hashFrozen(h, f.vals[i], seen)
+		}
+		return h
+	case *frozenFunc:
+		seen[f] = len(seen)
+		h = hashProto(fnv1a.AddString64(h, "function"), f.proto)
+		for _, uv := range f.upvalues {
+			h = hashFrozen(h, uv, seen)
+		}
+		return h
+	case unavailable:
+		return fnv1a.AddString64(h, "unavailable "+f.typ.String())
+	case lua.LNumber:
+		return fnv1a.AddUint64(fnv1a.AddString64(h, "number"), math.Float64bits(float64(f)))
+	case lua.LValue:
+		return fnv1a.AddString64(fnv1a.AddString64(h, f.Type().String()), f.String())
+	}
+	panic("unreachable")
+}
+
+func hashProto(h uint64, p *lua.FunctionProto) uint64 {
+	h = fnv1a.AddUint64(h, uint64(p.NumParameters))
+	h = fnv1a.AddUint64(h, uint64(p.IsVarArg))
+	for _, c := range p.Code {
+		h = fnv1a.AddUint64(h, uint64(c))
+	}
+	for _, c := range p.Constants {
+		h = hashFrozen(h, c, nil)
+	}
+	for _, fp := range p.FunctionPrototypes {
+		h = hashProto(h, fp)
+	}
+	return h
+}
+
+// Text returns the recorded recipe, which contains the hash of the function.
+func (r *LuaRecipe) Text() string {
+	return fmt.Sprintf("lua function %016x", r.hash)
+}
+
+func (r *LuaRecipe) String() string {
+	return fmt.Sprintf("lua function (%s:%d)", filepath.Base(r.file), r.line)
+}
+
+// Run calls the function in a new Lua state, with the variables 'inputs',
+// 'input', 'outputs', 'output', 'match', 'matches', and 'dep' set, along with
+// the target variables.
+func (r *LuaRecipe) Run(args rules.FuncArgs) error {
+	vm := &LuaVM{
+		L: lua.NewState(lua.Options{SkipOpenLibs: true}),
+	}
+	defer vm.L.Close()
+	vm.OpenDefaults()
+
+	vm.SetVar("inputs", args.Inputs)
+	vm.SetVar("input", strings.Join(args.Inputs, " "))
+	vm.SetVar("outputs", args.Outputs)
+	vm.SetVar("output", strings.Join(args.Outputs, " "))
+	vm.SetVar("match", args.Match)
+	vm.SetVar("matches", args.Matches)
+	vm.SetVar("dep", args.Dep)
+	for name, val := range args.Vars {
+		vm.SetVar(name, val)
+	}
+
+	fn := thaw(vm.L, r.fn, make(map[frozen]lua.LValue))
+	return vm.L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	})
+}
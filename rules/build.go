@@ -9,10 +9,14 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/zyedidia/knit/shell"
 )
 
 type Printer interface {
@@ -27,11 +31,52 @@ type Printer interface {
 type InfoFn func(msg string)
 
 type Options struct {
-	NoExec       bool   // don't execute recipes
-	Shell        string // use shell for executing commands
-	AbortOnError bool   // stop if an error happens in a recipe
-	BuildAll     bool   // build all rules even if they are up-to-date
-	Hash         bool   // use hashes to determine whether a file has been modified
+	NoExec            bool     // don't execute recipes
+	Shell             string   // use shell for executing commands
+	AbortOnError      bool     // stop if an error happens in a recipe
+	BuildAll          bool     // build all rules even if they are up-to-date
+	Hash              bool     // use hashes to determine whether a file has been modified
+	ShowRecipeChanges bool     // print how a recipe changed before re-running it
+	Hermetic          bool     // recipes don't read stdin unless they are interactive
+	Env               []string // environment that recipes are run with
+	VerifyOutputs     bool     // fail if a recipe does not create all of its outputs
+	InProcess         bool     // run recipes with the internal shell in this process
+	// called when a recipe finishes, on the goroutine that called Exec
+	OnNode func(ev NodeEvent)
+}
+
+// A NodeEvent describes a recipe that has finished running.
+type NodeEvent struct {
+	Name     string   // the node's target
+	Targets  []string // all targets of the node's rule
+	Err      error    // nil if the recipe succeeded
+	Duration time.Duration
+}
+
+// An eventQueue passes events from the workers to the goroutine that called
+// Exec, so that event handlers are called one at a time from one goroutine.
+type eventQueue struct {
+	lock   sync.Mutex
+	events []NodeEvent
+	ready  chan struct{}
+}
+
+func (q *eventQueue) push(ev NodeEvent) {
+	q.lock.Lock()
+	q.events = append(q.events, ev)
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) pop() []NodeEvent {
+	q.lock.Lock()
+	events := q.events
+	q.events = nil
+	q.lock.Unlock()
+	return events
 }
 
 type Executor struct {
@@ -50,6 +95,11 @@ type Executor struct {
 	rebuilt atomic.Bool
 	err     error
 
+	// held while a VM is in use, since they are shared with OnNode
+	vmLock sync.Mutex
+
+	events eventQueue
+
 	opts Options
 }
 
@@ -61,6 +111,9 @@ func NewExecutor(basedir string, db *Database, threads int, printer Printer, inf
 		jobs:    make(chan *node, 128),
 		threads: threads,
 		info:    info,
+		events: eventQueue{
+			ready: make(chan struct{}, 1),
+		},
 	}
 }
 
@@ -69,6 +122,11 @@ type command struct {
 	args   []string
 	recipe string
 	dir    string
+	env    []string
+	// the command may read from stdin
+	interactive bool
+	// files passed to the command's process as descriptors 3 and up
+	extra []*os.File
 }
 
 // Exec runs all commands and returns true if something was rebuilt.
@@ -89,8 +147,34 @@ func (e *Executor) Exec(g *Graph) (bool, error) {
 	// send all jobs into e.jobs
 	e.execNode(g.base)
 
-	// wait for base to complete
-	g.base.wait()
+	// wait for base to complete, while handling events
+	if e.opts.OnNode != nil {
+		done := make(chan struct{})
+		go func() {
+			g.base.wait()
+			close(done)
+		}()
+	loop:
+		for {
+			select {
+			case <-e.events.ready:
+				e.vmLock.Lock()
+				for _, ev := range e.events.pop() {
+					e.opts.OnNode(ev)
+				}
+				e.vmLock.Unlock()
+			case <-done:
+				break loop
+			}
+		}
+		e.vmLock.Lock()
+		for _, ev := range e.events.pop() {
+			e.opts.OnNode(ev)
+		}
+		e.vmLock.Unlock()
+	} else {
+		g.base.wait()
+	}
 
 	// no more jobs to send
 	close(e.jobs)
@@ -114,7 +198,8 @@ func (e *Executor) execNode(n *node) {
 	e.lock.Unlock()
 	// fmt.Println("exec", n.rule.targets)
 
-	for _, p := range n.prereqs {
+	// generated prereqs are only known once the generator has run
+	for _, p := range n.staticPrereqs() {
 		e.execNode(p)
 	}
 
@@ -122,18 +207,38 @@ func (e *Executor) execNode(n *node) {
 	// are done, so all nodes wait for their prereqs in parallel.
 	dojob := func() {
 		// wait for all prereqs to finish
-		for _, p := range n.prereqs {
+		for _, p := range n.staticPrereqs() {
 			p.wait()
 		}
 
+		if n.rule.attrs.Dyndep != "" && !e.opts.NoExec && !e.stopped.Load() {
+			if !e.extend(n, n.graph.LoadDyndep) {
+				return
+			}
+		}
+		if len(n.genPrereqs) != 0 && !e.opts.NoExec && !e.stopped.Load() {
+			if !e.extend(n, n.graph.LoadGenerated) {
+				return
+			}
+		}
+
 		e.lock.Lock()
-		// Cannot do dynamic step elision if hashing is disabled.
-		ood := n.outOfDate(e.db, e.opts.Hash, e.opts.Hash)
+		if len(n.listings) != 0 && n.tracked != nil {
+			// the prereqs may have changed the listed directories
+			n.updateListings()
+		}
+		// Without hashing, dynamic step elision only happens for prereqs with
+		// the restat attribute.
+		ood := n.outOfDate(e.db, e.opts.Hash, true)
 		if !e.opts.BuildAll && !n.rule.attrs.Linked && (ood == UpToDate || ood == UpToDateDynamic) {
 			n.setDone(e.db, e.opts.NoExec, e.opts.Hash)
-			if ood == UpToDateDynamic && len(n.rule.recipe) != 0 {
-				log.Println(n.rule.targets, "elided")
-				e.step.Add(1)
+			if ood == UpToDateDynamic {
+				// the outputs were not touched, so dependents can be elided
+				n.unchanged = true
+				if len(n.rule.recipe) != 0 {
+					log.Println(n.rule.targets, "elided")
+					e.step.Add(1)
+				}
 			}
 			e.lock.Unlock()
 			return
@@ -168,7 +273,68 @@ func (e *Executor) execNode(n *node) {
 	}
 }
 
+// Extends the graph with 'load' now that the prereqs of 'n' have been built,
+// and runs any prereqs that it adds before 'n' is scheduled. Returns false if
+// the graph could not be extended, in which case 'n' has failed.
+func (e *Executor) extend(n *node, load func(n *node) ([]*node, error)) bool {
+	e.lock.Lock()
+	changed, err := load(n)
+	if err == nil {
+		err = e.expand(n, changed)
+	}
+	if err != nil {
+		e.err = fmt.Errorf("'%s': %w", strings.Join(n.rule.targets, " "), err)
+		e.stopped.Store(true)
+		n.setDoneOrErr()
+		e.lock.Unlock()
+		return false
+	}
+	prereqs := append([]*node(nil), n.prereqs...)
+	e.lock.Unlock()
+
+	for _, p := range prereqs {
+		e.execNode(p)
+	}
+	for _, p := range prereqs {
+		p.wait()
+	}
+	return true
+}
+
+// Expands the recipes of 'n' and 'nodes', and of their prereqs, which may have
+// been added to the graph during the build. Recipes that are already expanded
+// are not expanded again.
+func (e *Executor) expand(n *node, nodes []*node) error {
+	vm := n.graph.vm
+	if vm == nil {
+		return nil
+	}
+	e.vmLock.Lock()
+	defer e.vmLock.Unlock()
+	for _, pn := range append(nodes, n) {
+		if err := pn.expandRecipe(vm, nil); err != nil {
+			return err
+		}
+		for _, p := range pn.prereqs {
+			if err := p.expandRecipe(vm, pn.propagated()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (e *Executor) runServer() {
+	// each worker has its own internal shell for in-process recipes
+	var runner *shell.Runner
+	if e.opts.InProcess {
+		var err error
+		runner, err = shell.NewRunner()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
 	for n := range e.jobs {
 		if len(n.rule.recipe) == 0 {
 			e.lock.Lock()
@@ -212,30 +378,72 @@ func (e *Executor) runServer() {
 		e.lock.Lock()
 		step := e.step.Add(1)
 
+		if e.opts.ShowRecipeChanges && n.outOfDate(e.db, e.opts.Hash, false) == RecipeModified {
+			if diff, ok := n.recipeDiff(e.db); ok {
+				e.info(fmt.Sprintf("recipe for '%s' changed:\n%s", ruleName, strings.Join(diff, "\n")))
+			}
+		}
+
 		failed := false
 		var execErr error
-		for i, cmd := range n.recipe {
-			c, err := e.getCmd(cmd, n.dir)
-			if err != nil {
-				execErr = fmt.Errorf("'%s': error while evaluating '%s': %w", ruleName, cmd, err)
-				failed = true
-				break
-			} else if c.recipe == "" {
-				continue
-			}
+		start := time.Now()
+		if n.rule.fn != nil {
 			if !n.rule.attrs.Quiet {
-				e.printer.Print(c.recipe, c.dir, ruleName, int(step))
-			}
-			if i == 0 {
-				e.lock.Unlock()
+				e.printer.Print(n.rule.fn.String(), n.dir, ruleName, int(step))
 			}
+			e.lock.Unlock()
 			if !e.opts.NoExec {
-				err := e.execCmd(c)
+				err := n.rule.fn.Run(n.funcArgs())
 				if err != nil {
-					execErr = fmt.Errorf("'%s': error during recipe: %w", strings.Join(n.rule.targets, " "), err)
+					execErr = fmt.Errorf("'%s': error during recipe: %w", ruleName, err)
 					if e.opts.AbortOnError && !n.rule.attrs.NonStop {
 						failed = true
-						break
+					}
+				}
+			}
+		} else if n.rule.attrs.OneShell {
+			e.lock.Unlock()
+			print := func(cmd string) {
+				if !n.rule.attrs.Quiet {
+					e.printer.Print(cmd, n.dir, ruleName, int(step))
+				}
+			}
+			if err := e.execScript(n, runner, print); err != nil {
+				execErr = fmt.Errorf("'%s': error during recipe: %w", ruleName, err)
+				if e.opts.AbortOnError && !n.rule.attrs.NonStop {
+					failed = true
+				}
+			}
+		} else {
+			for i, cmd := range n.recipe {
+				c, err := e.getCmd(cmd, n.dir, e.environ(n))
+				if err != nil {
+					execErr = fmt.Errorf("'%s': error while evaluating '%s': %w", ruleName, cmd, err)
+					failed = true
+					break
+				} else if c.recipe == "" {
+					continue
+				}
+				c.interactive = !e.opts.Hermetic || n.rule.attrs.Interactive
+				if !n.rule.attrs.Quiet {
+					e.printer.Print(c.recipe, c.dir, ruleName, int(step))
+				}
+				if i == 0 {
+					e.lock.Unlock()
+				}
+				if !e.opts.NoExec {
+					var err error
+					if runner != nil && !n.rule.attrs.Shell {
+						err = e.runCmd(runner, c)
+					} else {
+						err = e.execCmd(c)
+					}
+					if err != nil {
+						execErr = fmt.Errorf("'%s': error during recipe: %w", strings.Join(n.rule.targets, " "), err)
+						if e.opts.AbortOnError && !n.rule.attrs.NonStop {
+							failed = true
+							break
+						}
 					}
 				}
 			}
@@ -244,6 +452,31 @@ func (e *Executor) runServer() {
 
 		e.lock.Lock()
 
+		if !failed && !e.opts.NoExec && !n.rule.attrs.Virtual {
+			if e.opts.VerifyOutputs {
+				if err := n.verifyOutputs(); err != nil {
+					execErr = fmt.Errorf("'%s': %w", ruleName, err)
+					failed = true
+				}
+			}
+			if !failed && n.rule.attrs.Restat {
+				n.unchanged = true
+				for _, f := range n.outputs {
+					if f.restat() {
+						n.unchanged = false
+					}
+				}
+				ptime := n.prereqTime()
+				for _, f := range n.outputs {
+					if n.unchanged {
+						e.db.Restats[f.name] = ptime
+					} else {
+						delete(e.db.Restats, f.name)
+					}
+				}
+			}
+		}
+
 		if failed {
 			if !n.rule.attrs.Virtual {
 				for _, t := range n.rule.targets {
@@ -256,6 +489,18 @@ func (e *Executor) runServer() {
 			}
 			e.stopped.Store(true)
 			e.err = execErr
+		}
+
+		if e.opts.OnNode != nil {
+			e.events.push(NodeEvent{
+				Name:     n2str(n),
+				Targets:  n.rule.targets,
+				Err:      execErr,
+				Duration: time.Since(start),
+			})
+		}
+
+		if failed {
 			n.setDoneOrErr()
 		} else {
 			n.setDone(e.db, e.opts.NoExec, e.opts.Hash)
@@ -266,13 +511,24 @@ func (e *Executor) runServer() {
 	}
 }
 
-func (e *Executor) getCmd(cmd string, dir string) (command, error) {
+// Returns an error if one of the node's outputs does not exist.
+func (n *node) verifyOutputs() error {
+	for _, f := range n.outputs {
+		if !exists(f.name) {
+			return fmt.Errorf("recipe did not create '%s'", f.name)
+		}
+	}
+	return nil
+}
+
+func (e *Executor) getCmd(cmd string, dir string, env []string) (command, error) {
 	if e.opts.Shell != "" {
 		return command{
 			name:   e.opts.Shell,
 			args:   []string{"-c", cmd},
 			recipe: cmd,
 			dir:    dir,
+			env:    env,
 		}, nil
 	}
 	path, err := os.Executable()
@@ -284,18 +540,208 @@ func (e *Executor) getCmd(cmd string, dir string) (command, error) {
 		args:   []string{"--shrun", cmd},
 		recipe: cmd,
 		dir:    dir,
+		env:    env,
 	}, nil
 }
 
+// Returns the environment that this node's recipe must run with, or nil if it
+// can inherit the environment of this process. The environment variables that
+// the rule depends on are set to the values that were tracked for it.
+func (e *Executor) environ(n *node) []string {
+	vars := n.rule.attrs.EnvVars()
+	base := e.opts.Env
+	if n.graph.env != nil {
+		base = n.graph.env
+	}
+	if base == nil {
+		if len(vars) == 0 {
+			return nil
+		}
+		base = os.Environ()
+	}
+	tracked := make(map[string]bool, len(vars))
+	for _, v := range vars {
+		tracked[v] = true
+	}
+	env := make([]string, 0, len(base))
+	for _, kv := range base {
+		k, _, _ := strings.Cut(kv, "=")
+		if !tracked[k] {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range vars {
+		if val, ok := n.tracked[envInput+v]; ok {
+			env = append(env, v+"="+val)
+		}
+	}
+	return env
+}
+
+// Runs the node's recipe as a single script that exits as soon as a command
+// fails. The script is split into its top-level statements, and each one is
+// printed with 'print' as it starts running, so that the failing statement can
+// be reported.
+func (e *Executor) execScript(n *node, runner *shell.Runner, print func(cmd string)) error {
+	script := strings.Join(n.recipe, "\n")
+	starts, err := shell.StmtLines(script)
+	if err != nil {
+		return err
+	}
+	// returns the range of recipe lines of the statements starting at
+	// starts[i], which continue until the next statements start
+	span := func(i int) (from, to int) {
+		from, to = starts[i]-1, len(n.recipe)
+		if i+1 < len(starts) {
+			to = starts[i+1] - 1
+		}
+		return from, to
+	}
+	stmts := func(i int) string {
+		from, to := span(i)
+		for to > from && strings.TrimSpace(n.recipe[to-1]) == "" {
+			to--
+		}
+		return strings.Join(n.recipe[from:to], "\n")
+	}
+	if e.opts.NoExec {
+		for i := range starts {
+			print(stmts(i))
+		}
+		return nil
+	}
+
+	last := -1
+	// without a shell to run the script, it is run with the internal shell
+	if runner == nil && e.opts.Shell == "" {
+		if runner, err = shell.NewRunner(); err != nil {
+			return err
+		}
+	}
+	if runner != nil && (!n.rule.attrs.Shell || e.opts.Shell == "") {
+		c := command{
+			recipe:      script,
+			dir:         n.dir,
+			env:         e.environ(n),
+			interactive: !e.opts.Hermetic || n.rule.attrs.Interactive,
+		}
+		stdin, stdout, stderr := e.streams(c)
+		err = runner.RunScript(script, c.dir, c.env, stdin, stdout, stderr, func(line int) {
+			last++
+			print(stmts(last))
+		})
+	} else {
+		// the script writes the index of each statement to descriptor 3
+		// before running it
+		pr, pw, perr := os.Pipe()
+		if perr != nil {
+			return perr
+		}
+		buf := &strings.Builder{}
+		buf.WriteString("set -e\n")
+		for i := range starts {
+			from, to := span(i)
+			if i == 0 {
+				// keep any comments before the first statement
+				from = 0
+			}
+			fmt.Fprintf(buf, "echo %d >&3\n", i)
+			for _, l := range n.recipe[from:to] {
+				buf.WriteString(l)
+				buf.WriteByte('\n')
+			}
+		}
+		c, cerr := e.getCmd(buf.String(), n.dir, e.environ(n))
+		if cerr != nil {
+			pr.Close()
+			pw.Close()
+			return cerr
+		}
+		c.interactive = !e.opts.Hermetic || n.rule.attrs.Interactive
+		c.extra = []*os.File{pw}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scanner := bufio.NewScanner(pr)
+			for scanner.Scan() {
+				i, aerr := strconv.Atoi(scanner.Text())
+				if aerr == nil && i >= 0 && i < len(starts) {
+					last = i
+					print(stmts(i))
+				}
+			}
+		}()
+		err = e.execCmd(c)
+		pw.Close()
+		// a background process started by the script may still hold the
+		// descriptor open, so only wait for the markers that were written
+		pr.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		<-done
+		pr.Close()
+	}
+	if err != nil && last >= 0 {
+		return fmt.Errorf("line %d '%s': %w", starts[last], stmts(last), err)
+	}
+	return err
+}
+
+// Returns the streams that a command's input and output are connected to when
+// it is run in this process.
+func (e *Executor) streams(c command) (stdin io.Reader, stdout, stderr io.Writer) {
+	if c.interactive {
+		stdin = os.Stdin
+	}
+	if e.printer.NeedsUpdate() {
+		return stdin, &printerWriter{e.printer, os.Stdout}, &printerWriter{e.printer, os.Stderr}
+	}
+	return stdin, os.Stdout, os.Stderr
+}
+
+// Saves the database so that a knit command run from within knit can use it,
+// and returns a function that reloads it once the command is done. The
+// database is shared with the other jobs, so it is locked while it is saved
+// and reloaded.
+func (e *Executor) saveDb() (reload func()) {
+	e.lock.Lock()
+	e.db.Save()
+	e.lock.Unlock()
+	return func() {
+		e.lock.Lock()
+		e.db.Reload()
+		e.lock.Unlock()
+	}
+}
+
+// Runs a command with the internal shell in this process.
+func (e *Executor) runCmd(r *shell.Runner, c command) error {
+	if strings.HasPrefix(c.recipe, "knit ") {
+		defer e.saveDb()()
+	}
+	stdin, stdout, stderr := e.streams(c)
+	return r.Run(c.recipe, c.dir, c.env, stdin, stdout, stderr)
+}
+
 func (e *Executor) execCmd(c command) error {
 	// Save and reload DB when running a knit command from within knit
 	if len(c.args) >= 2 && strings.HasPrefix(c.args[1], "knit ") {
-		e.db.Save()
-		defer e.db.Reload()
+		defer e.saveDb()()
+	}
+	if e.opts.Shell == "" {
+		// simple file operations are run directly by the internal shell's
+		// builtins, without starting a process
+		stdin, stdout, stderr := e.streams(c)
+		if ok, err := shell.RunBuiltin(c.recipe, c.dir, stdin, stdout, stderr); ok {
+			return err
+		}
 	}
 	cmd := exec.Command(c.name, c.args...)
 	cmd.Dir = c.dir
-	cmd.Stdin = os.Stdin
+	cmd.Env = c.env
+	cmd.ExtraFiles = c.extra
+	if c.interactive {
+		cmd.Stdin = os.Stdin
+	}
 
 	if e.printer.NeedsUpdate() {
 		stdout, _ := cmd.StdoutPipe()
@@ -324,6 +770,19 @@ func forwardStream(p Printer, stream io.Reader, w io.Writer) {
 	}
 }
 
+// A printerWriter clears the printer's status around every write.
+type printerWriter struct {
+	p Printer
+	w io.Writer
+}
+
+func (pw *printerWriter) Write(b []byte) (int, error) {
+	pw.p.Clear()
+	n, err := pw.w.Write(b)
+	pw.p.Update()
+	return n, err
+}
+
 // Returns true if 'path' exists.
 func exists(path string) bool {
 	_, err := os.Stat(path)
@@ -2,13 +2,16 @@ package rules
 
 import (
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
 	"io"
 	"io/fs"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -26,6 +29,31 @@ func hashSlice(s []string) uint64 {
 	return fnv1a.HashString64(strings.Join(s, ""))
 }
 
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Hashes a recipe along with the values of its tracked inputs.
+func hashRecipe(recipe []string, inputs map[string]string) uint64 {
+	h := hashSlice(recipe)
+	for _, k := range sortedKeys(inputs) {
+		h = fnv1a.AddString64(h, k+"="+inputs[k])
+	}
+	return h
+}
+
+// Returns the hash of the value of a tracked input that is stored in the
+// database instead of the value.
+func hashInput(val string) string {
+	h := sha256.Sum256([]byte(val))
+	return hex.EncodeToString(h[:])
+}
+
 func hashSliceAndString(s []string, str string) uint64 {
 	return fnv1a.HashString64(strings.Join(s, "") + str)
 }
@@ -97,6 +125,12 @@ func NewDatabase(dir string) *Database {
 	if d.OutputDirs == nil {
 		d.OutputDirs = make(map[string]bool)
 	}
+	if d.Restats == nil {
+		d.Restats = make(map[string]time.Time)
+	}
+	if d.Checks == nil {
+		d.Checks = make(map[uint64]bool)
+	}
 
 	return &Database{
 		location: dir,
@@ -116,6 +150,7 @@ func (db *Database) Save() error {
 	if err := os.MkdirAll(db.location, os.ModePerm); err != nil {
 		return err
 	}
+	db.Recipes.prune()
 	f, err := os.Create(filepath.Join(db.location, dataFile))
 	if err != nil {
 		return err
@@ -129,18 +164,28 @@ type data struct {
 	Prereqs    Prereqs
 	Outputs    map[string]bool
 	OutputDirs map[string]bool
+	// outputs of restat rules that were not modified when the rule last ran,
+	// mapped to the time of the newest prereq at that point
+	Restats map[string]time.Time
+	// results of configuration checks, keyed by a hash of the compiler and
+	// the test program
+	Checks map[uint64]bool
 }
 
 func newData() *data {
 	return &data{
 		Recipes: Recipes{
 			Hashes: make(map[uint64]uint64),
+			Texts:  make(map[uint64][]string),
+			Inputs: make(map[uint64]map[string]string),
 		},
 		Prereqs: Prereqs{
 			Hashes: make(map[uint64]*Files),
 		},
 		Outputs:    make(map[string]bool),
 		OutputDirs: make(map[string]bool),
+		Restats:    make(map[string]time.Time),
+		Checks:     make(map[uint64]bool),
 	}
 }
 
@@ -173,6 +218,12 @@ func loadData(d io.Reader) (*data, error) {
 	if dat.Recipes.Hashes == nil {
 		dat.Recipes.Hashes = make(map[uint64]uint64)
 	}
+	if dat.Recipes.Texts == nil {
+		dat.Recipes.Texts = make(map[uint64][]string)
+	}
+	if dat.Recipes.Inputs == nil {
+		dat.Recipes.Inputs = make(map[uint64]map[string]string)
+	}
 	if dat.Prereqs.Hashes == nil {
 		dat.Prereqs.Hashes = make(map[uint64]*Files)
 	}
@@ -183,6 +234,13 @@ func loadData(d io.Reader) (*data, error) {
 type Recipes struct {
 	// map from hash of targets to hash of recipe contents
 	Hashes map[uint64]uint64
+	// map from hash of recipe contents to the full recipe, shared by all
+	// targets that use the same recipe
+	Texts map[uint64][]string
+	// map from hash of targets to hashes of the values of the inputs that are
+	// tracked alongside the recipe, such as environment variables. Only hashes
+	// are stored so that secrets in the environment are not written to disk.
+	Inputs map[uint64]map[string]string
 }
 
 const (
@@ -191,8 +249,8 @@ const (
 	hasAll
 )
 
-func (r *Recipes) has(targets, recipe []string, dir string) int {
-	rhash := hashSlice(recipe)
+func (r *Recipes) has(targets, recipe []string, inputs map[string]string, dir string) int {
+	rhash := hashRecipe(recipe, inputs)
 	thash := hashSliceAndString(targets, dir)
 	if h, ok := r.Hashes[thash]; ok {
 		if rhash == h {
@@ -203,10 +261,69 @@ func (r *Recipes) has(targets, recipe []string, dir string) int {
 	return noTargets
 }
 
-func (r *Recipes) insert(targets, recipe []string, dir string) {
-	rhash := hashSlice(recipe)
+func (r *Recipes) insert(targets, recipe []string, inputs map[string]string, dir string) {
+	rhash := hashRecipe(recipe, inputs)
 	thash := hashSliceAndString(targets, dir)
 	r.Hashes[thash] = rhash
+	if _, ok := r.Texts[rhash]; !ok {
+		r.Texts[rhash] = append([]string(nil), recipe...)
+	}
+	if len(inputs) != 0 {
+		hashes := make(map[string]string, len(inputs))
+		for k, v := range inputs {
+			hashes[k] = hashInput(v)
+		}
+		r.Inputs[thash] = hashes
+	} else {
+		delete(r.Inputs, thash)
+	}
+}
+
+// changedInput returns the name of a tracked input whose value differs from
+// the one recorded for the targets. Returns false if nothing changed, or if
+// nothing has been recorded.
+func (r *Recipes) changedInput(targets []string, inputs map[string]string, dir string) (string, bool) {
+	thash := hashSliceAndString(targets, dir)
+	if _, ok := r.Hashes[thash]; !ok {
+		return "", false
+	}
+	old := r.Inputs[thash]
+	for _, k := range sortedKeys(inputs) {
+		if ov, ok := old[k]; !ok || ov != hashInput(inputs[k]) {
+			return k, true
+		}
+	}
+	for _, k := range sortedKeys(old) {
+		if _, ok := inputs[k]; !ok {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// text returns the recipe that was last recorded for the targets, if there is
+// one.
+func (r *Recipes) text(targets []string, dir string) ([]string, bool) {
+	thash := hashSliceAndString(targets, dir)
+	h, ok := r.Hashes[thash]
+	if !ok {
+		return nil, false
+	}
+	recipe, ok := r.Texts[h]
+	return recipe, ok
+}
+
+// prune removes recipes that are no longer referenced by any targets.
+func (r *Recipes) prune() {
+	used := make(map[uint64]bool, len(r.Hashes))
+	for _, h := range r.Hashes {
+		used[h] = true
+	}
+	for h := range r.Texts {
+		if !used[h] {
+			delete(r.Texts, h)
+		}
+	}
 }
 
 type Prereqs struct {
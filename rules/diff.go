@@ -0,0 +1,48 @@
+package rules
+
+// diffLines computes a line-based diff between 'old' and 'new' using the
+// longest common subsequence. Each returned line is prefixed with '-' if it was
+// removed, '+' if it was added, or ' ' if it is unchanged.
+func diffLines(old, new []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of old[i:]
+	// and new[j:]
+	lcs := make([][]int, len(old)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]string, 0, len(old)+len(new))
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			diff = append(diff, " "+old[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+old[i])
+			i++
+		default:
+			diff = append(diff, "+"+new[j])
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		diff = append(diff, "-"+old[i])
+	}
+	for ; j < len(new); j++ {
+		diff = append(diff, "+"+new[j])
+	}
+	return diff
+}
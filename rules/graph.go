@@ -2,15 +2,20 @@ package rules
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gobwas/glob"
+	"github.com/segmentio/fasthash/fnv1a"
 	"github.com/zyedidia/knit/expand"
+	"github.com/zyedidia/knit/shell"
 )
 
 // Number of times a meta-rule can be used in one dependency chain.
@@ -22,9 +27,88 @@ type Graph struct {
 	fullNodes map[string]*node // map of all targets, including incidental ones, to nodes
 
 	rules *RuleSet
+	// VM that expanded the recipes, and the environment that they run with
+	vm  VM
+	env []string
 
 	// timestamp cache
 	tscache map[string]time.Time
+	// files that are treated as updated, for nodes added during the build
+	updated map[string]bool
+
+	// if non-nil, rule selection decisions are recorded here
+	trace *resolveTrace
+
+	// in strict mode, targets that several rules could build are reported
+	strict   bool
+	warnings []string
+	warned   map[string]bool
+
+	// if non-nil, the indices of the meta-rules used to resolve a target
+	usedMeta map[int]bool
+}
+
+// RulesGraph returns a graph of the rules in 'rs' without any targets, whose
+// recipes are expanded by 'vm'. It is used by tools that inspect the rules
+// themselves, when the requested targets cannot be resolved.
+func RulesGraph(rs *RuleSet, vm VM, updated map[string]bool) *Graph {
+	g := newGraph(rs, updated)
+	g.vm = vm
+	g.env = vm.Environ()
+	return g
+}
+
+// Returns an empty graph for the rules in 'rs'.
+func newGraph(rs *RuleSet, updated map[string]bool) *Graph {
+	return &Graph{
+		nodes:     make(map[string]*node),
+		fullNodes: make(map[string]*node),
+		rules:     rs,
+		tscache:   make(map[string]time.Time),
+		updated:   updated,
+		warned:    make(map[string]bool),
+	}
+}
+
+// Resolves 'target' and the targets it depends on into the graph.
+func (g *Graph) resolve(target string) (*node, error) {
+	visits := make([]int, len(g.rules.metaRules))
+	return g.resolveTarget(prereq{name: target}, visits, g.updated)
+}
+
+// Records a warning about an ambiguous rule, if the graph is strict. Each
+// warning is only recorded once.
+func (g *Graph) warn(format string, args ...interface{}) {
+	if !g.strict {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if g.warned[msg] {
+		return
+	}
+	g.warned[msg] = true
+	g.warnings = append(g.warnings, msg)
+}
+
+// Warnings returns the ambiguities found while building the graph in strict
+// mode.
+func (g *Graph) Warnings() []string {
+	return g.warnings
+}
+
+// A resolveTrace records why each candidate rule was or was not used while
+// resolving a target. Only the decisions for the target itself are printed;
+// prereqs resolved along the way are reported by their outcome.
+type resolveTrace struct {
+	w     io.Writer
+	depth int
+}
+
+func (t *resolveTrace) printf(indent int, format string, args ...interface{}) {
+	if t == nil || t.depth != 1 {
+		return
+	}
+	fmt.Fprintf(t.w, "%s%s\n", strings.Repeat("  ", indent), fmt.Sprintf(format, args...))
 }
 
 // Each node represents a build step. Certain nodes share information (e.g., if
@@ -37,19 +121,43 @@ type node struct {
 	// explicit prereqs are substituted for $input
 	myExpPrereqs []string
 	myOutput     *file
+	// lengths of myPrereqs and myExpPrereqs before generated prereqs
+	myGenBase    [2]int
+	myGenSpliced bool
 
 	memoized   [2]bool
 	memoUpdate [2]UpdateReason
+	// tracked input that caused the node to be out-of-date
+	changed string
 }
 
 type info struct {
+	graph    *Graph // graph that the node was created in
 	outputs  map[string]*file
 	rule     *DirectRule
 	recipe   []string
+	tracked  map[string]string // values of inputs tracked with the recipe
 	prereqs  []*node
 	dir      string
 	optional map[int]bool
 
+	// hashes of the files matched by each glob prereq
+	globs map[string]string
+	// patterns of the directories whose listings are tracked, and the prereqs
+	// that are only tracked by their listing
+	listings []string
+	listed   map[*info]bool
+
+	// variables bound to the targets, and inherited from dependents
+	vars      []targetVar
+	inherited []targetVar
+	scope     map[string]string // values of the variables
+
+	// prereqs that are expanded from the manifests of generators
+	genPrereqs []genPrereq
+	genBase    int // number of prereqs before generated prereqs
+	genSpliced bool
+
 	// for cycle checking
 	visited  int
 	expanded bool
@@ -58,6 +166,8 @@ type info struct {
 	cond   *sync.Cond
 	done   bool
 	queued bool
+	// the outputs were not modified when this node ran (restat)
+	unchanged bool
 
 	// for meta rules
 	meta    bool
@@ -65,6 +175,15 @@ type info struct {
 	matches []string
 }
 
+// A genPrereq is a pattern prereq with the F attribute, such as 'gen/%.o'. It
+// stands for a prereq for each file listed in the manifest of the generator
+// that builds the pattern's directory.
+type genPrereq struct {
+	pattern string
+	dir     string // directory built by the generator
+	attrs   AttrSet
+}
+
 // Wait until this node's condition variable is signaled.
 func (n *node) wait() {
 	n.cond.L.Lock()
@@ -89,6 +208,9 @@ func (n *node) setDone(db *Database, noexec, hash bool) {
 	if !noexec {
 		if hash {
 			for _, p := range n.prereqs {
+				if n.listed[p.info] {
+					continue
+				}
 				for _, f := range p.outputs {
 					// TODO: think about path normalization?
 					db.Prereqs.insert(n.rule.targets, f.name, n.dir)
@@ -106,7 +228,7 @@ func (n *node) setDone(db *Database, noexec, hash bool) {
 			}
 		}
 		// TODO: think about path normalization?
-		db.Recipes.insert(n.rule.targets, n.recipe, n.dir)
+		db.Recipes.insert(n.rule.targets, n.recipe, n.tracked, n.dir)
 		for _, f := range n.outputs {
 			if len(n.recipe) != 0 {
 				db.AddOutput(f.name)
@@ -125,6 +247,14 @@ type file struct {
 	updated bool
 }
 
+// Re-reads the file's timestamp from the filesystem, and returns true if the
+// file was modified or created since its timestamp was last read.
+func (f *file) restat() bool {
+	t, exists := f.t, f.exists
+	f.updateTimestamp(make(map[string]time.Time))
+	return f.exists && (!exists || !f.t.Equal(t))
+}
+
 func newFile(target string, updated map[string]bool, tscache map[string]time.Time) *file {
 	f := &file{
 		name: target,
@@ -190,6 +320,7 @@ func (g *Graph) newNode(target string, updated map[string]bool) *node {
 			outputs: map[string]*file{
 				target: newFile(target, updated, g.tscache),
 			},
+			graph:    g,
 			cond:     sync.NewCond(&sync.Mutex{}),
 			optional: make(map[int]bool),
 		},
@@ -197,25 +328,204 @@ func (g *Graph) newNode(target string, updated map[string]bool) *node {
 	return n
 }
 
-func (g *Graph) Size() int {
-	return len(g.nodes)
+// Returns a virtual node named 'target' to use as the base of a graph that
+// is not resolved from a single target. Its prereqs are added by the caller.
+func (g *Graph) virtualBase(target string) *node {
+	rule := NewDirectRuleBase([]string{target}, nil, nil, AttrSet{
+		Virtual: true,
+		NoMeta:  true,
+		Rebuild: true,
+	})
+	return &node{
+		info: &info{
+			graph:    g,
+			rule:     &rule,
+			cond:     sync.NewCond(&sync.Mutex{}),
+			optional: make(map[int]bool),
+			expanded: true,
+		},
+		myTarget: target,
+	}
 }
 
-func NewGraph(rs *RuleSet, target string, updated map[string]bool) (g *Graph, err error) {
-	g = &Graph{
+// JoinGraphs returns a graph that builds the targets of all of 'graphs', so
+// that they can be executed together. The nodes of each graph still belong to
+// the graph that they were created in, and are expanded with its VM. An output
+// that is built by more than one graph is built by a single node if the
+// graphs build it the same way, and is an error otherwise. The 'names' of the
+// graphs are used in the error.
+func JoinGraphs(graphs []*Graph, names []string) (*Graph, error) {
+	if len(graphs) == 1 {
+		return graphs[0], nil
+	}
+	g := &Graph{
 		nodes:     make(map[string]*node),
 		fullNodes: make(map[string]*node),
-		rules:     rs,
+		rules:     NewRuleSet("."),
 		tscache:   make(map[string]time.Time),
+		updated:   make(map[string]bool),
 	}
-	visits := make([]int, len(rs.metaRules))
-	g.base, err = g.resolveTarget(prereq{name: target}, visits, updated)
+	g.base = g.virtualBase(":build")
+	owners := make(map[*info]string)
+	for i, sub := range graphs {
+		if err := g.share(sub, names[i], owners); err != nil {
+			return nil, err
+		}
+		g.base.prereqs = append(g.base.prereqs, sub.base)
+		g.base.myPrereqs = append(g.base.myPrereqs, sub.base.myTarget)
+		for k, n := range sub.nodes {
+			g.nodes[k] = n
+		}
+		for k, n := range sub.fullNodes {
+			g.fullNodes[k] = n
+		}
+		g.warnings = append(g.warnings, sub.warnings...)
+		for dir, b := range sub.rules.builddirs {
+			if g.rules.builddirs == nil {
+				g.rules.builddirs = make(map[string]string)
+			}
+			g.rules.builddirs[dir] = b
+		}
+	}
+	g.base.myExpPrereqs = g.base.myPrereqs
+	g.nodes[":build"] = g.base
+	return g, nil
+}
+
+// Makes the nodes of 'sub' that build an output already built by the joined
+// graph use the existing node instead, so that the output is only built once.
+// The outputs of the graph named 'name' are recorded in 'owners'.
+func (g *Graph) share(sub *Graph, name string, owners map[*info]string) error {
+	outputs := make([]string, 0, len(sub.fullNodes))
+	for k := range sub.fullNodes {
+		outputs = append(outputs, k)
+	}
+	sort.Strings(outputs)
+	shared := make(map[*info]*info)
+	for _, k := range outputs {
+		n := sub.fullNodes[k]
+		if n.rule.attrs.Virtual || shared[n.info] != nil {
+			continue
+		}
+		prev, ok := g.fullNodes[k]
+		if !ok || prev.info == n.info {
+			owners[n.info] = name
+			continue
+		}
+		if !sameStep(prev.info, n.info) {
+			return fmt.Errorf("'%s' is built differently by %s and %s", k, owners[prev.info], name)
+		}
+		shared[n.info] = prev.info
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	for _, m := range []map[string]*node{sub.nodes, sub.fullNodes} {
+		for _, n := range m {
+			if i, ok := shared[n.info]; ok {
+				n.info = i
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the expanded nodes 'a' and 'b' build their outputs the same
+// way.
+func sameStep(a, b *info) bool {
+	if a.dir != b.dir || a.rule.attrs != b.rule.attrs || a.rule.fn != b.rule.fn ||
+		!equal(a.recipe, b.recipe) || len(a.prereqs) != len(b.prereqs) ||
+		len(a.tracked) != len(b.tracked) {
+		return false
+	}
+	for k, v := range a.tracked {
+		if tv, ok := b.tracked[k]; !ok || tv != v {
+			return false
+		}
+	}
+	for i, p := range a.prereqs {
+		if pathJoin(p.dir, p.myTarget) != pathJoin(b.prereqs[i].dir, b.prereqs[i].myTarget) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *Graph) Size() int {
+	return len(g.nodes)
+}
+
+func NewGraph(rs *RuleSet, target string, updated map[string]bool, strict bool) (g *Graph, err error) {
+	g = newGraph(rs, updated)
+	g.strict = strict
+	g.base, err = g.resolve(target)
 	if err != nil {
 		return g, err
 	}
+	if err := g.loadDynamic(); err != nil {
+		return g, err
+	}
 	return g, checkCycles(g.base)
 }
 
+// AllGraph returns a graph of all targets of 'rs', with their recipes
+// expanded by 'vm'. Targets that cannot be resolved or expanded are left out,
+// so that an error in one target does not prevent inspecting the others.
+func AllGraph(rs *RuleSet, vm VM, updated map[string]bool) *Graph {
+	g := RulesGraph(rs, vm, updated)
+	targets := rs.AllTargets()
+	sort.Strings(targets)
+	var roots []*node
+	for _, t := range targets {
+		if n, err := g.resolve(t); err == nil {
+			roots = append(roots, n)
+		}
+	}
+	// errors are left for the graph of the requested targets to report
+	g.loadDynamic()
+
+	// expand the nodes that no other node depends on first, so that their
+	// variables are propagated to their prereqs
+	deps := make(map[*info]bool)
+	for _, n := range roots {
+		markDeps(n, deps)
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		return !deps[roots[i].info] && deps[roots[j].info]
+	})
+	g.base = g.virtualBase(":all")
+	for _, n := range roots {
+		if checkCycles(n) != nil || n.expandRecipe(vm, nil) != nil {
+			continue
+		}
+		g.base.prereqs = append(g.base.prereqs, n)
+		g.base.myPrereqs = append(g.base.myPrereqs, n2str(n))
+	}
+	g.base.myExpPrereqs = g.base.myPrereqs
+	g.nodes[":all"] = g.base
+	return g
+}
+
+// Loads the dyndep files and manifests that already exist, so that the nodes
+// using them are up-to-date only if their dynamic deps are.
+func (g *Graph) loadDynamic() error {
+	for _, n := range g.nodesWhere(func(n *node) bool { return n.rule.attrs.Dyndep != "" }) {
+		if exists(pathJoin(n.dir, n.rule.attrs.Dyndep)) {
+			if _, err := g.LoadDyndep(n); err != nil {
+				return err
+			}
+		}
+	}
+	for _, n := range g.nodesWhere(func(n *node) bool { return len(n.genPrereqs) != 0 }) {
+		if g.manifestsExist(n) {
+			if _, err := g.LoadGenerated(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func rel(basepath, targpath string) (string, error) {
 	if filepath.IsAbs(targpath) {
 		var err error
@@ -245,6 +555,11 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	if err != nil {
 		return nil, err
 	}
+	if g.trace != nil {
+		g.trace.depth++
+		defer func() { g.trace.depth-- }()
+	}
+	g.trace.printf(0, "target '%s'", fulltarget)
 
 	// do we have a node that builds target already
 	// if the node has an empty recipe, we don't use it because it could be a
@@ -263,6 +578,8 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 
 	var rule DirectRule
 	var expprereqs []string
+	globs := make(map[string]string)
+	listings := make(map[string]bool)
 	// do we have a direct rule available?
 	ris, ok := g.rules.targets[fulltarget]
 	if ok && len(ris) > 0 {
@@ -272,13 +589,28 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 		// last one.
 		for _, ri := range ris {
 			r := &g.rules.directRules[ri]
+			rprereqs, err := expandPrereqs(r.dir, r.prereqs, globs, listings)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Location(), err)
+			}
+			rprereqs = g.vpath(r.dir, rprereqs, visits, updated)
 			if len(r.recipe) != 0 {
+				if len(rule.recipe) != 0 {
+					g.trace.printf(1, "direct rule %s overrides %s", r.Location(), rule.Location())
+					if r.dir != rule.dir {
+						g.warn("'%s': rule at %s in buildset '%s' shadows rule at %s in buildset '%s'", fulltarget, r.Location(), r.dir, rule.Location(), rule.dir)
+					} else {
+						g.warn("'%s': rule at %s overrides rule at %s", fulltarget, r.Location(), rule.Location())
+					}
+				}
+				g.trace.printf(1, "direct rule %s: '%s' (recipe)", r.Location(), r.String())
 				// recipe exists -- overwrite prereqs
-				prereqs = r.prereqs
-				expprereqs = prereqsStr(r.prereqs, true)
+				prereqs = rprereqs
+				expprereqs = prereqsStr(rprereqs, true)
 			} else {
+				g.trace.printf(1, "direct rule %s: '%s' (prereqs only)", r.Location(), r.String())
 				// recipe is empty -- only add the prereqs
-				prereqs = append(prereqs, r.prereqs...)
+				prereqs = append(prereqs, rprereqs...)
 			}
 			// copy over the attrs/targets/recipe into 'rule' if the currently
 			// matched rule has a recipe (it is a full rule), or the
@@ -291,6 +623,8 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	} else if ok {
 		// should not happen
 		return nil, fmt.Errorf("internal error: target %s exists but has no rules", target.name)
+	} else {
+		g.trace.printf(1, "no direct rules")
 	}
 	var ri = -1
 
@@ -298,7 +632,11 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 
 	// if we did not find a recipe from the direct rules and this target can
 	// use meta-rules, then search all meta-rules for a match
-	if len(rule.recipe) == 0 && !rule.attrs.NoMeta {
+	if len(rule.recipe) != 0 {
+		g.trace.printf(1, "meta-rules not searched: direct rule has a recipe")
+	} else if rule.attrs.NoMeta {
+		g.trace.printf(1, "meta-rules not searched: target is marked no-meta")
+	} else {
 		// search backwards so that we get the last rule to match first, and
 		// then can skip subsequent full rules (with recipes), and add
 		// subsequent prereq rules (rules without recipes).
@@ -310,7 +648,10 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 			if err != nil {
 				return nil, err
 			}
-			if sub, pat := mr.Match(reltarget); sub != nil {
+			sub, pat := mr.Match(reltarget)
+			if sub == nil {
+				g.trace.printf(1, "meta-rule %s: '%s' does not match", mr.Location(), mr.String())
+			} else {
 				// a meta-rule can only be used maxVisits times (in one dependency path)
 				// TODO: consider moving this back above the if statement so that we skip
 				// the performance cost of matching if maxVisits is exceeded. In order to
@@ -318,41 +659,68 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 				// we only want to print a warning when the rule is a match.
 				if visits[mi] >= maxVisits {
 					log.Printf("could not use metarule '%s': exceeded max visits\n", mr.String())
+					g.trace.printf(1, "meta-rule %s: '%s' matches, but was already used %d times in this dependency chain", mr.Location(), mr.String(), maxVisits)
 					continue
 				}
 				// if this rule has a recipe and we already have a recipe, skip it
-				if curtarg != "" && len(curtarg) <= len(reltarget) && len(mr.recipe) > 0 && len(best.recipe) > 0 {
-					continue
+				// (in strict mode, only once we know that it could have been
+				// used)
+				shadowed := curtarg != "" && len(curtarg) <= len(reltarget) && len(mr.recipe) > 0 && len(best.recipe) > 0
+				if shadowed {
+					if best.dir != mr.dir {
+						g.trace.printf(1, "meta-rule %s: '%s' matches, but is shadowed by %s from buildset '%s'", mr.Location(), mr.String(), best.Location(), best.dir)
+					} else {
+						g.trace.printf(1, "meta-rule %s: '%s' matches, but is overridden by %s", mr.Location(), mr.String(), best.Location())
+					}
+					if !g.strict {
+						continue
+					}
 				}
 
 				var metarule DirectRule
+				var match string
+				var matches []string
 				metarule.attrs = mr.attrs
 				metarule.recipe = mr.recipe
+				metarule.fn = mr.fn
 				metarule.dir = mr.dir
+				metarule.file = mr.file
+				metarule.line = mr.line
 
 				// there should be exactly 1 submatch (2 indices for full
 				// match, 2 for the submatch) for a % match.
 				if pat.Suffix && len(sub) == 4 {
 					// %-metarule -- the match is the submatch and all %s in the
 					// prereqs get expanded to the submatch
-					n.match = string(reltarget[sub[2]:sub[3]])
+					match = string(reltarget[sub[2]:sub[3]])
+					g.trace.printf(1, "meta-rule %s: '%s' matches with stem '%s'", mr.Location(), mr.String(), match)
 					for _, p := range mr.prereqs {
-						p.name = strings.ReplaceAll(p.name, "%", n.match)
+						p.name = strings.ReplaceAll(p.name, "%", match)
 						metarule.prereqs = append(metarule.prereqs, p)
 					}
-					metarule.attrs.Dep = strings.ReplaceAll(metarule.attrs.Dep, "%", n.match)
+					metarule.attrs.Dep = strings.ReplaceAll(metarule.attrs.Dep, "%", match)
+					metarule.attrs.Dyndep = strings.ReplaceAll(metarule.attrs.Dyndep, "%", match)
 				} else {
 					// regex match, accumulate all the matches and expand them in the prereqs
 					for i := 0; i < len(sub); i += 2 {
-						n.matches = append(n.matches, string(reltarget[sub[i]:sub[i+1]]))
+						matches = append(matches, string(reltarget[sub[i]:sub[i+1]]))
 					}
+					g.trace.printf(1, "meta-rule %s: '%s' matches with submatches '%s'", mr.Location(), mr.String(), strings.Join(matches, "' '"))
 					for _, p := range mr.prereqs {
 						expanded := pat.Regex.ExpandString([]byte{}, p.name, reltarget, sub)
 						metarule.prereqs = append(metarule.prereqs, prereq{name: string(expanded), attrs: p.attrs})
 					}
 					expanded := pat.Regex.ExpandString([]byte{}, rule.attrs.Dep, reltarget, sub)
 					metarule.attrs.Dep = string(expanded)
+					expanded = pat.Regex.ExpandString([]byte{}, metarule.attrs.Dyndep, reltarget, sub)
+					metarule.attrs.Dyndep = string(expanded)
+				}
+
+				metarule.prereqs, err = expandPrereqs(metarule.dir, metarule.prereqs, globs, listings)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", mr.Location(), err)
 				}
+				metarule.prereqs = g.vpath(metarule.dir, metarule.prereqs, visits, updated)
 
 				// Only use this rule if its prereqs can also be resolved.
 				failed := false
@@ -362,15 +730,29 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 					_, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(metarule.dir, p.name)}, visits, updated)
 					if err != nil {
 						log.Printf("could not use metarule '%s': %s\n", mr.String(), err)
+						g.trace.printf(2, "prereq '%s': %v", p.name, err)
 						failed = true
 						break
 					}
+					g.trace.printf(2, "prereq '%s': ok", p.name)
 				}
 				visits[mi]--
 
 				if failed {
+					g.trace.printf(2, "not used: a prereq could not be resolved")
 					continue
 				}
+				if shadowed {
+					if best.dir != mr.dir {
+						g.warn("'%s': rule at %s in buildset '%s' shadows rule at %s in buildset '%s'", fulltarget, best.Location(), best.dir, mr.Location(), mr.dir)
+					} else {
+						g.warn("'%s': meta-rules at %s and %s match with equal priority; using %s", fulltarget, best.Location(), mr.Location(), best.Location())
+					}
+					continue
+				}
+
+				n.match = match
+				n.matches = matches
 
 				// success -- add the prereqs
 				best.dir = metarule.dir
@@ -381,20 +763,35 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 					best.prereqs = append(rule.prereqs, metarule.prereqs...)
 					best.attrs = metarule.attrs
 					best.recipe = metarule.recipe
+					best.fn = metarule.fn
+					best.file = metarule.file
+					best.line = metarule.line
 					best.targets = []string{reltarget}
+					g.trace.printf(2, "used for its recipe")
 				} else {
 					best.prereqs = append(best.prereqs, metarule.prereqs...)
+					g.trace.printf(2, "used for its prereqs")
 				}
 				curtarg = reltarget
 
 				n.meta = true
 				ri = mi // for visit tracking
+				if g.usedMeta != nil {
+					g.usedMeta[mi] = true
+				}
 			}
 		}
 		rule = best
 	}
 
 	n.dir = rule.dir
+	if len(globs) != 0 {
+		n.globs = globs
+	}
+	for pattern := range listings {
+		n.listings = append(n.listings, pattern)
+	}
+	sort.Strings(n.listings)
 
 	rule.attrs.UpdateFrom(target.attrs)
 
@@ -403,6 +800,37 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 		rule.prereqs = loadDeps(n.dir, rule.prereqs, dep, fulltarget, n.optional)
 		n.outputs[dep] = newFile(pathJoin(n.dir, rule.attrs.Dep), updated, g.tscache)
 	}
+	if rule.attrs.Manifest != "" {
+		manifest := pathJoin(rule.dir, rule.attrs.Manifest)
+		n.outputs[manifest] = newFile(manifest, updated, g.tscache)
+	}
+	if hasGenerated(rule.prereqs) {
+		// each generated prereq is replaced by the directory that its files
+		// are generated in, so that the generator runs first
+		prereqs := make([]prereq, 0, len(rule.prereqs))
+		for _, p := range rule.prereqs {
+			if p.attrs.Generated {
+				dir, err := genDir(p.name)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", rule.Location(), err)
+				}
+				n.genPrereqs = append(n.genPrereqs, genPrereq{
+					pattern: p.name,
+					dir:     dir,
+					attrs:   p.attrs,
+				})
+				p = prereq{name: dir, attrs: AttrSet{Implicit: true}}
+			}
+			prereqs = append(prereqs, p)
+		}
+		rule.prereqs = prereqs
+	}
+	if rule.attrs.Dyndep != "" {
+		// the dyndep file must be built before the rule runs
+		prereqs := make([]prereq, 0, len(rule.prereqs)+1)
+		prereqs = append(prereqs, rule.prereqs...)
+		rule.prereqs = append(prereqs, prereq{name: rule.attrs.Dyndep, attrs: AttrSet{Implicit: true}})
+	}
 
 	if rule.attrs.Virtual {
 		n.outputs = nil
@@ -411,14 +839,26 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	if len(rule.targets) == 0 && !rule.attrs.Virtual {
 		for o, f := range n.outputs {
 			if !f.exists {
+				g.trace.printf(1, "chosen: none, and the file does not exist")
 				return nil, fmt.Errorf("no rule to knit target '%s'", o)
 			}
 		}
+		g.trace.printf(1, "chosen: none, the file exists")
 		// If this rule had no targets, the target is the requested one. For
 		// example, maybe we didn't find a rule, and the requested target was
 		// foo.c. If foo.c exists, then this is an empty rule to "build" it.
 		rule.targets = []string{fulltarget}
+	} else if g.trace != nil {
+		kind := "direct rule"
+		if n.meta {
+			kind = "meta-rule"
+		}
+		if len(rule.recipe) == 0 {
+			kind += " without a recipe"
+		}
+		g.trace.printf(1, "chosen: %s %s in buildset '%s'", kind, rule.Location(), rule.dir)
 	}
+	n.vars = g.rules.varsFor(n.dir, rule.targets)
 
 	n.myPrereqs = prereqsStr(rule.prereqs, false)
 	n.myExpPrereqs = expprereqs
@@ -471,7 +911,9 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 	for i, p := range n.rule.prereqs {
 		pn, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(n.dir, p.name)}, visits, updated)
 		if err != nil {
-			if n.optional[i] {
+			// a listing prereq for a directory that does not exist (and that
+			// no rule builds) has an empty listing
+			if n.optional[i] || p.attrs.Listing && !exists(pathJoin(n.dir, p.name)) {
 				continue
 			}
 			// there was an error with a prereq, so this node is invalid and we
@@ -482,6 +924,12 @@ func (g *Graph) resolveTarget(target prereq, visits []int, updated map[string]bo
 			}
 			return nil, err
 		}
+		if p.attrs.Listing {
+			if n.listed == nil {
+				n.listed = make(map[*info]bool)
+			}
+			n.listed[pn.info] = true
+		}
 		n.prereqs = append(n.prereqs, pn)
 	}
 
@@ -520,10 +968,505 @@ func loadDeps(dir string, prereqs []prereq, depfile string, target string, opt m
 	return prereqs
 }
 
+// Returns the nodes in the graph for which 'pred' is true.
+func (g *Graph) nodesWhere(pred func(n *node) bool) []*node {
+	var nodes []*node
+	seen := make(map[*info]bool)
+	for _, n := range g.nodes {
+		if pred(n) && !seen[n.info] {
+			seen[n.info] = true
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// LoadDyndep reads the dyndep file of 'n' and splices the deps that it lists
+// into the graph. The file uses the same syntax as a D file, with rules that
+// have no recipes. The prereqs of a rule are added to the node that builds
+// its targets, and targets that the node does not yet build become outputs of
+// the node, so that they may be used as prereqs by other dyndep files. Returns
+// the nodes that were given new prereqs. Loading a file again only adds deps
+// that are new.
+func (g *Graph) LoadDyndep(n *node) ([]*node, error) {
+	depfile := pathJoin(n.dir, n.rule.attrs.Dyndep)
+	data, err := os.ReadFile(depfile)
+	if err != nil {
+		return nil, fmt.Errorf("dyndep: %w", err)
+	}
+	rs := NewRuleSet(n.dir)
+	if err := ParseInto(string(data), rs, depfile, 1); err != nil {
+		return nil, fmt.Errorf("dyndep: %w", err)
+	}
+
+	// a rule applies to a node if one of its targets is built by a node that
+	// uses this dyndep file
+	owner := func(r *DirectRule) *node {
+		for _, t := range r.targets {
+			if dn, ok := g.fullNodes[pathJoin(r.dir, t)]; ok && pathJoin(dn.dir, dn.rule.attrs.Dyndep) == depfile {
+				return dn
+			}
+		}
+		return nil
+	}
+
+	// add all outputs first, so that prereqs can refer to outputs added by
+	// later rules
+	for i := range rs.directRules {
+		r := &rs.directRules[i]
+		if len(r.recipe) != 0 {
+			return nil, fmt.Errorf("%s: cannot have recipe in dyndep file", r.Location())
+		}
+		dn := owner(r)
+		if dn == nil {
+			continue
+		}
+		for _, t := range r.targets {
+			full := pathJoin(r.dir, t)
+			if _, ok := g.fullNodes[full]; ok {
+				continue
+			}
+			reltarget, err := rel(dn.dir, full)
+			if err != nil {
+				return nil, err
+			}
+			g.addOutput(dn, reltarget, full)
+		}
+	}
+
+	var changed []*node
+	for i := range rs.directRules {
+		r := &rs.directRules[i]
+		dn := owner(r)
+		if dn == nil {
+			continue
+		}
+		added := false
+		for _, p := range r.prereqs {
+			visits := make([]int, len(g.rules.metaRules))
+			pn, err := g.resolveTarget(prereq{attrs: p.attrs, name: pathJoin(r.dir, p.name)}, visits, g.updated)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Location(), err)
+			}
+			if pn.info == dn.info || hasPrereq(dn, pn) {
+				continue
+			}
+			if dependsOn(pn, dn, make(map[*info]bool)) {
+				return nil, fmt.Errorf("%s: cycle detected at rule %v", r.Location(), pn.rule)
+			}
+			dn.prereqs = append(dn.prereqs, pn)
+			added = true
+		}
+		if added {
+			dn.memoized = [2]bool{}
+			changed = append(changed, dn)
+		}
+	}
+	return changed, nil
+}
+
+func hasPrereq(n, p *node) bool {
+	for _, pn := range n.prereqs {
+		if pn.info == p.info {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds 'target' (relative to the node's directory) as an output of 'n', found
+// during the build. 'full' is the path of the target.
+func (g *Graph) addOutput(n *node, target, full string) {
+	n.outputs[target] = newFile(full, g.updated, g.tscache)
+	g.fullNodes[full] = n
+	// dependents use a separate node, so that they track this output rather
+	// than the node's target
+	g.nodes[full] = &node{
+		info:         n.info,
+		myTarget:     target,
+		myPrereqs:    n.myPrereqs,
+		myExpPrereqs: n.myExpPrereqs,
+		myOutput:     newFile(full, g.updated, g.tscache),
+	}
+}
+
+// Returns true if 'n' depends on 'p', directly or indirectly.
+func dependsOn(n, p *node, visited map[*info]bool) bool {
+	if n.info == p.info {
+		return true
+	}
+	visited[n.info] = true
+	for _, pn := range n.prereqs {
+		if !visited[pn.info] && dependsOn(pn, p, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns 'prereqs' with each glob prereq replaced by the files that match it,
+// relative to 'dir', and each listing prereq replaced by its directory. The
+// hash of each glob's matches is stored in 'globs', and the pattern of each
+// listing prereq is added to 'listings'.
+func expandPrereqs(dir string, prereqs []prereq, globs map[string]string, listings map[string]bool) ([]prereq, error) {
+	special := false
+	for _, p := range prereqs {
+		special = special || p.attrs.Glob || p.attrs.Listing
+	}
+	if !special {
+		return prereqs, nil
+	}
+	expanded := make([]prereq, 0, len(prereqs))
+	for _, p := range prereqs {
+		if p.attrs.Listing {
+			listings[p.name] = true
+			expanded = append(expanded, prereq{name: listingDir(p.name), attrs: p.attrs})
+			continue
+		} else if !p.attrs.Glob {
+			expanded = append(expanded, p)
+			continue
+		}
+		matches, err := globFiles(dir, p.name)
+		if err != nil {
+			return nil, err
+		}
+		attrs := p.attrs
+		attrs.Glob = false
+		for _, m := range matches {
+			expanded = append(expanded, prereq{name: m, attrs: attrs})
+		}
+		globs[p.name] = fmt.Sprintf("%x", fnv1a.HashString64(strings.Join(matches, "\n")))
+	}
+	return expanded, nil
+}
+
+// Returns the build directories of the graph's rule sets, relative to the
+// current directory.
+func (g *Graph) buildDirs() []string {
+	var dirs []string
+	for dir, b := range g.rules.builddirs {
+		if b != "" {
+			dirs = append(dirs, filepath.Join(dir, b))
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Returns 'prereqs' of a rule in 'dir', with each prereq in a rule set that has a
+// build directory replaced by its path in the build directory, if it exists
+// there or can be built there. Otherwise the prereq is found in the source
+// tree, as with VPATH in Make.
+func (g *Graph) vpath(dir string, prereqs []prereq, visits []int, updated map[string]bool) []prereq {
+	if len(g.rules.builddirs) == 0 {
+		return prereqs
+	}
+	var found []prereq
+	for i, p := range prereqs {
+		if p.attrs.Generated || p.attrs.Listing {
+			continue
+		}
+		full, err := relify(pathJoin(dir, p.name))
+		if err != nil {
+			continue
+		}
+		alt, ok := g.rules.buildPath(full)
+		if !ok {
+			continue
+		}
+		if _, err := g.resolveTarget(prereq{name: alt, attrs: p.attrs}, visits, updated); err != nil {
+			continue
+		}
+		if p.name, err = rel(dir, alt); err != nil {
+			continue
+		}
+		if found == nil {
+			found = append([]prereq(nil), prereqs...)
+		}
+		found[i] = p
+	}
+	if found == nil {
+		return prereqs
+	}
+	return found
+}
+
+// Returns the directory of the listing prereq 'pattern', which is either a
+// directory or a glob pattern for entries in a directory.
+func listingDir(pattern string) string {
+	i := strings.IndexAny(pattern, "*?[{")
+	if i == -1 {
+		return pattern
+	}
+	return filepath.Dir(pattern[:i] + "_")
+}
+
+// Returns a hash of the listing of the entries that match 'pattern' relative
+// to 'dir'. Each entry is listed by its path and type, so the hash changes
+// when an entry is added, removed, or changes type, but not when the contents
+// of a file change. If 'pattern' is a directory its direct entries are listed.
+// A directory that does not exist has an empty listing.
+func listingHash(dir, pattern string) (string, error) {
+	root := listingDir(pattern)
+	var g glob.Glob
+	depth := 1
+	if root != pattern {
+		var err error
+		g, err = glob.Compile(strings.ReplaceAll(pattern, "**/", "{,**/}"), '/')
+		if err != nil {
+			return "", fmt.Errorf("listing '%s': %w", pattern, err)
+		}
+		depth = strings.Count(pattern, "/") - strings.Count(root, "/")
+		if root == "." {
+			depth++
+		}
+		if strings.Contains(pattern, "**") {
+			depth = -1
+		}
+	}
+
+	var entries []string
+	base := pathJoin(dir, root)
+	err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if path == base {
+			return nil
+		}
+		relpath, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(pathJoin(root, relpath))
+		if g == nil || g.Match(name) {
+			typ := "f"
+			if d.IsDir() {
+				typ = "d"
+			} else if d.Type()&fs.ModeSymlink != 0 {
+				typ = "l"
+			}
+			entries = append(entries, typ+" "+name)
+		}
+		if d.IsDir() && depth != -1 && strings.Count(relpath, string(filepath.Separator))+1 >= depth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", fnv1a.HashString64(strings.Join(entries, "\n"))), nil
+}
+
+// Computes the hashes of the directory listings that the node tracks, which
+// may have changed since the recipe was expanded if a prereq has run.
+func (n *node) updateListings() {
+	for _, pattern := range n.listings {
+		h, err := listingHash(n.dir, pattern)
+		if err != nil {
+			log.Println(err)
+		}
+		n.tracked[listInput+pattern] = h
+	}
+	n.memoized = [2]bool{}
+}
+
+// Returns the files that match the glob 'pattern' relative to 'dir', in
+// lexical order. In addition to the syntax of filepath.Match, '**/' matches
+// any number of directories.
+func globFiles(dir, pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pathJoin(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("glob '%s': %w", pattern, err)
+		}
+		for i, m := range matches {
+			if matches[i], err = rel(dir, m); err != nil {
+				return nil, err
+			}
+		}
+		return matches, nil
+	}
+
+	// '**/' also matches no directories
+	g, err := glob.Compile(strings.ReplaceAll(pattern, "**/", "{,**/}"), '/')
+	if err != nil {
+		return nil, fmt.Errorf("glob '%s': %w", pattern, err)
+	}
+	// only walk the directory before the first wildcard
+	root := pattern[:strings.IndexAny(pattern, "*?[{")]
+	root = root[:strings.LastIndex(root, "/")+1]
+	var matches []string
+	err = filepath.WalkDir(pathJoin(dir, root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relpath, err := rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if g.Match(filepath.ToSlash(relpath)) {
+			matches = append(matches, relpath)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// Returns the prereqs of 'n' other than those loaded from manifests, which may
+// be out-of-date until the generators have run.
+func (n *node) staticPrereqs() []*node {
+	if n.genSpliced {
+		return n.prereqs[:n.genBase]
+	}
+	return n.prereqs
+}
+
+func hasGenerated(prereqs []prereq) bool {
+	for _, p := range prereqs {
+		if p.attrs.Generated {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the directory of the generated prereq 'pattern', which must contain
+// exactly one '%'.
+func genDir(pattern string) (string, error) {
+	if strings.Count(pattern, "%") != 1 {
+		return "", fmt.Errorf("generated prereq '%s' must contain one '%%'", pattern)
+	}
+	dir := filepath.Dir(pattern[:strings.Index(pattern, "%")] + "_")
+	if dir == "." {
+		return "", fmt.Errorf("generated prereq '%s' must be in a directory", pattern)
+	}
+	return dir, nil
+}
+
+// Returns true if the manifests of all generators that 'n' uses exist.
+func (g *Graph) manifestsExist(n *node) bool {
+	for _, gp := range n.genPrereqs {
+		gn, ok := g.nodes[pathJoin(n.dir, gp.dir)]
+		if !ok || gn.rule.attrs.Manifest == "" || !exists(pathJoin(gn.dir, gn.rule.attrs.Manifest)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads a manifest, which lists one file per line.
+func readManifest(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// LoadGenerated reads the manifests of the generators that 'n' uses, and
+// replaces the generated prereqs of 'n' with a prereq for each listed file
+// that matches. For the pattern 'gen/%.o', the file 'gen/foo.c' gives the
+// prereq 'gen/foo.o', which is resolved like any other prereq (usually by a
+// meta-rule). Files whose prereq cannot be resolved are skipped. Returns the
+// new prereqs. The listed files become outputs of the generator. The recipe of
+// 'n' must be expanded again afterwards.
+func (g *Graph) LoadGenerated(n *node) ([]*node, error) {
+	if !n.genSpliced {
+		n.genBase = len(n.prereqs)
+		n.genSpliced = true
+	}
+	if !n.myGenSpliced {
+		n.myGenBase = [2]int{len(n.myPrereqs), len(n.myExpPrereqs)}
+		n.myGenSpliced = true
+	}
+	n.prereqs = n.prereqs[:n.genBase]
+	n.myPrereqs = n.myPrereqs[:n.myGenBase[0]]
+	n.myExpPrereqs = n.myExpPrereqs[:n.myGenBase[1]]
+
+	var added []*node
+	seen := make(map[string]bool)
+	for _, gp := range n.genPrereqs {
+		gn, ok := g.nodes[pathJoin(n.dir, gp.dir)]
+		if !ok {
+			return nil, fmt.Errorf("internal error: no node for generated directory '%s'", gp.dir)
+		}
+		if gn.rule.attrs.Manifest == "" {
+			return nil, fmt.Errorf("'%s' is not built by a rule with a manifest (W attribute)", gp.dir)
+		}
+		files, err := readManifest(pathJoin(gn.dir, gn.rule.attrs.Manifest))
+		if err != nil {
+			return nil, fmt.Errorf("manifest: %w", err)
+		}
+		// the listed files are outputs of the generator, so that anything
+		// built from them runs after it
+		for _, f := range files {
+			full := pathJoin(gn.dir, f)
+			if _, ok := g.nodes[full]; !ok {
+				g.addOutput(gn, f, full)
+			}
+		}
+		prefix := gp.pattern[:strings.Index(gp.pattern, "%")]
+		suffix := gp.pattern[strings.Index(gp.pattern, "%")+1:]
+		attrs := gp.attrs
+		attrs.Generated = false
+		for _, f := range files {
+			relf, err := rel(n.dir, pathJoin(gn.dir, f))
+			if err != nil {
+				return nil, err
+			}
+			stem := strings.TrimSuffix(relf, filepath.Ext(relf))
+			if !strings.HasPrefix(stem, prefix) {
+				continue
+			}
+			name := stem + suffix
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			visits := make([]int, len(g.rules.metaRules))
+			pn, err := g.resolveTarget(prereq{attrs: attrs, name: pathJoin(n.dir, name)}, visits, g.updated)
+			if err != nil {
+				log.Printf("could not use generated prereq '%s': %s\n", name, err)
+				continue
+			}
+			if dependsOn(pn, n, make(map[*info]bool)) {
+				return nil, fmt.Errorf("cycle detected at rule %v", pn.rule)
+			}
+			n.prereqs = append(n.prereqs, pn)
+			n.myPrereqs = append(n.myPrereqs, name)
+			if !attrs.Implicit {
+				n.myExpPrereqs = append(n.myExpPrereqs, name)
+			}
+			added = append(added, pn)
+		}
+	}
+	n.memoized = [2]bool{}
+	n.expanded = false
+	return added, nil
+}
+
 func prereqsStr(prereqs []prereq, onlyexp bool) []string {
 	exp := make([]string, 0, len(prereqs))
 	for _, p := range prereqs {
-		if !onlyexp || !p.attrs.Implicit {
+		if !onlyexp || !p.attrs.Implicit && !p.attrs.Generated {
 			exp = append(exp, p.name)
 		}
 	}
@@ -544,21 +1487,120 @@ func (n *node) inputs() []string {
 type VM interface {
 	ExpandFuncs() (func(string) (string, error), func(string) (string, error))
 	SetVar(name string, val interface{})
+	// SetVars sets the string variables in 'vars', and returns a function
+	// that restores their previous values.
+	SetVars(vars map[string]string) (restore func())
+	// Environ returns the environment that recipes run with.
+	Environ() []string
+	Getenv(name string) (string, bool)
+	// HasTools returns true if any tools have fingerprints.
+	HasTools() bool
+	Fingerprint(tool string) (string, bool, error)
 }
 
+const (
+	// Prefix for tracked inputs that are environment variables.
+	envInput = "env:"
+	// Prefix for tracked inputs that are tool fingerprints.
+	toolInput = "tool:"
+	// Prefix for tracked inputs that are the files matched by a glob.
+	globInput = "glob:"
+	// Prefix for tracked inputs that are directory listings.
+	listInput = "listing:"
+	// Prefix for tracked inputs that are target variables.
+	varInput = "var:"
+)
+
 // ExpandRecipes evaluates all variables and expressions in the recipes for the
 // build
 func (g *Graph) ExpandRecipes(vm VM) error {
-	return g.base.expandRecipe(vm)
+	g.vm = vm
+	g.env = vm.Environ()
+	return g.base.expandRecipe(vm, nil)
+}
+
+// Returns the values of the variables that are set while this node's recipe
+// is expanded. Variables bound to patterns are applied first, then those
+// inherited from a dependent, then those bound to the node's targets. A
+// variable that is appended to starts from its value in the VM.
+func (n *node) varScope(vm VM) map[string]string {
+	if len(n.inherited) == 0 && len(n.vars) == 0 {
+		return nil
+	}
+	var patvars, targvars []targetVar
+	for _, v := range n.vars {
+		if len(v.patterns) != 0 {
+			patvars = append(patvars, v)
+		} else {
+			targvars = append(targvars, v)
+		}
+	}
+	rvar, _ := vm.ExpandFuncs()
+	scope := make(map[string]string)
+	for _, v := range append(append(patvars, n.inherited...), targvars...) {
+		if !v.append {
+			scope[v.name] = v.value
+			continue
+		}
+		cur, ok := scope[v.name]
+		if !ok {
+			cur, _ = rvar(v.name)
+		}
+		if cur == "" {
+			scope[v.name] = v.value
+		} else {
+			scope[v.name] = cur + " " + v.value
+		}
+	}
+	return scope
 }
 
-// Expand variable and expression references in this node's recipe. This
-// function will assign the appropriate variables in the Lua VM and then
-// evaluate the variables and expressions that must be expanded.
-func (n *node) expandRecipe(vm VM) error {
+// Returns the variables that this node passes on to its prereqs, in the order
+// that they apply to this node.
+func (n *node) propagated() []targetVar {
+	var vars []targetVar
+	for _, v := range n.vars {
+		if v.propagate && len(v.patterns) != 0 {
+			vars = append(vars, v)
+		}
+	}
+	vars = append(vars, n.inherited...)
+	for _, v := range n.vars {
+		if v.propagate && len(v.patterns) == 0 {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// Expand variable and expression references in this node's recipe, and in the
+// recipes of its prereqs. This function will assign the appropriate variables
+// in the Lua VM and then evaluate the variables and expressions that must be
+// expanded.
+func (n *node) expandRecipe(vm VM, inherited []targetVar) error {
 	if n.expanded {
 		return nil
 	}
+	if err := n.expandNode(vm, inherited); err != nil {
+		return err
+	}
+
+	vars := n.propagated()
+	for _, pn := range n.prereqs {
+		err := pn.expandRecipe(vm, vars)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Expands the recipe of this node only, with the variables 'inherited' from a
+// dependent node.
+func (n *node) expandNode(vm VM, inherited []targetVar) error {
+	n.inherited = inherited
+	n.scope = n.varScope(vm)
 
 	prs := n.myExpPrereqs
 	vm.SetVar("inputs", prs)
@@ -575,28 +1617,91 @@ func (n *node) expandRecipe(vm VM) error {
 	if n.rule.attrs.Dep != "" {
 		vm.SetVar("dep", n.rule.attrs.Dep)
 	}
+	restore := vm.SetVars(n.scope)
 	n.recipe = make([]string, 0, len(n.rule.recipe))
 	for _, c := range n.rule.recipe {
 		rvar, rexpr := vm.ExpandFuncs()
 		output, err := expand.Expand(c, rvar, rexpr, true)
 		if err != nil {
+			restore()
 			return err
 		}
 		n.recipe = append(n.recipe, output)
 	}
+	restore()
 
-	n.expanded = true
-
-	for _, pn := range n.prereqs {
-		err := pn.expandRecipe(vm)
+	n.tracked = make(map[string]string)
+	for pattern, h := range n.globs {
+		n.tracked[globInput+pattern] = h
+	}
+	n.updateListings()
+	for name, val := range n.scope {
+		n.tracked[varInput+name] = val
+	}
+	for _, v := range n.rule.attrs.EnvVars() {
+		if val, ok := vm.Getenv(v); ok {
+			n.tracked[envInput+v] = val
+		}
+	}
+	for _, c := range n.recipe {
+		if n.rule.fn != nil || !vm.HasTools() {
+			break
+		}
+		cmds, err := shell.Commands(c)
 		if err != nil {
-			return err
+			// the recipe will fail to run anyway, so just guess that the
+			// first word is the command
+			cmds = strings.Fields(c)
+			if len(cmds) > 1 {
+				cmds = cmds[:1]
+			}
+		}
+		for _, cmd := range cmds {
+			tool := filepath.Base(cmd)
+			fp, ok, err := vm.Fingerprint(tool)
+			if err != nil {
+				return fmt.Errorf("tool '%s': %w", tool, err)
+			}
+			if ok {
+				n.tracked[toolInput+tool] = fp
+			}
 		}
 	}
 
+	n.expanded = true
 	return nil
 }
 
+// Returns the arguments that this node's function recipe is run with.
+func (n *node) funcArgs() FuncArgs {
+	args := FuncArgs{
+		Inputs:  make([]string, 0, len(n.myExpPrereqs)),
+		Outputs: make([]string, 0, len(n.rule.targets)),
+		Match:   n.match,
+		Matches: n.matches,
+		Vars:    n.scope,
+	}
+	for _, p := range n.myExpPrereqs {
+		args.Inputs = append(args.Inputs, pathJoin(n.dir, p))
+	}
+	for _, t := range n.rule.targets {
+		args.Outputs = append(args.Outputs, pathJoin(n.dir, t))
+	}
+	if n.rule.attrs.Dep != "" {
+		args.Dep = pathJoin(n.dir, n.rule.attrs.Dep)
+	}
+	return args
+}
+
+// Returns the commands that this node runs. A function recipe is shown as a
+// comment.
+func (n *node) commands() []string {
+	if n.rule.fn != nil {
+		return []string{funcComment(n.rule.fn)}
+	}
+	return n.recipe
+}
+
 // checks the graph for cycles starting at node n
 func checkCycles(n *node) error {
 	n.visited = 1
@@ -625,6 +1730,39 @@ func (n *node) time() time.Time {
 	return t
 }
 
+// returns the time that the oldest output of this node was built. Outputs of
+// restat rules that were not modified by the recipe count as built at the time
+// of the newest prereq when the recipe ran.
+func (n *node) builtTime(db *Database) time.Time {
+	t := time.Now()
+	for _, f := range n.outputs {
+		ft := f.t
+		if rt, ok := db.Restats[f.name]; ok && rt.After(ft) {
+			ft = rt
+		}
+		if ft.Before(t) {
+			t = ft
+		}
+	}
+	return t
+}
+
+// returns the last modified time for the newest prereq of this node
+func (n *node) prereqTime() time.Time {
+	var t time.Time
+	for _, p := range n.prereqs {
+		if p.rule.attrs.Virtual {
+			continue
+		}
+		for _, f := range p.outputs {
+			if f.t.After(t) {
+				t = f.t
+			}
+		}
+	}
+	return t
+}
+
 type UpdateReason int
 
 const (
@@ -640,6 +1778,11 @@ const (
 	Prereq
 	LinkedUpdate
 	UpToDateDynamic
+	EnvModified
+	ToolModified
+	GlobModified
+	ListingModified
+	VarModified
 )
 
 func (u UpdateReason) String() string {
@@ -666,10 +1809,38 @@ func (u UpdateReason) String() string {
 		return "linked update"
 	case OnlyPrereqs:
 		return "only update prereqs"
+	case EnvModified:
+		return "env changed"
+	case ToolModified:
+		return "tool changed"
+	case GlobModified:
+		return "glob matches changed"
+	case ListingModified:
+		return "directory listing changed"
+	case VarModified:
+		return "target variable changed"
 	}
 	panic("unreachable")
 }
 
+// reason describes why the node is out-of-date, including the name of the
+// tracked input that changed, if there is one.
+func (n *node) reason(u UpdateReason) string {
+	switch u {
+	case EnvModified:
+		return fmt.Sprintf("%s: %s", u, strings.TrimPrefix(n.changed, envInput))
+	case ToolModified:
+		return fmt.Sprintf("%s: %s", u, strings.TrimPrefix(n.changed, toolInput))
+	case GlobModified:
+		return fmt.Sprintf("%s: %s", u, strings.TrimPrefix(n.changed, globInput))
+	case ListingModified:
+		return fmt.Sprintf("%s: %s", u, strings.TrimPrefix(n.changed, listInput))
+	case VarModified:
+		return fmt.Sprintf("%s: %s", u, strings.TrimPrefix(n.changed, varInput))
+	}
+	return u.String()
+}
+
 func (n *node) outOfDate(db *Database, hash, dynamic bool) UpdateReason {
 	var i int
 	if dynamic {
@@ -703,6 +1874,10 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 
 	// if a prereq is newer than an output, this rule is out of date
 	for _, p := range n.prereqs {
+		if n.listed[p.info] {
+			// only the listing is tracked, as an input of the recipe
+			continue
+		}
 		for _, f := range p.outputs {
 			if f.updated {
 				return ForceUpdate
@@ -718,7 +1893,7 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 					return Untracked
 				}
 			}
-		} else if !p.rule.attrs.Virtual && p.time().After(n.time()) {
+		} else if !p.rule.attrs.Virtual && p.time().After(n.builtTime(db)) {
 			log.Println(p.myTarget, "is newer than", n.myTarget)
 			return TimeModified
 		}
@@ -726,7 +1901,20 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 
 	// database doesn't have an entry for this recipe
 	if len(n.rule.recipe) != 0 {
-		has := db.Recipes.has(n.rule.targets, n.recipe, n.dir)
+		if changed, ok := db.Recipes.changedInput(n.rule.targets, n.tracked, n.dir); ok {
+			n.changed = changed
+			if strings.HasPrefix(changed, toolInput) {
+				return ToolModified
+			} else if strings.HasPrefix(changed, globInput) {
+				return GlobModified
+			} else if strings.HasPrefix(changed, listInput) {
+				return ListingModified
+			} else if strings.HasPrefix(changed, varInput) {
+				return VarModified
+			}
+			return EnvModified
+		}
+		has := db.Recipes.has(n.rule.targets, n.recipe, n.tracked, n.dir)
 		if has == noHash {
 			return RecipeModified
 		} else if has == noTargets {
@@ -736,26 +1924,46 @@ func (n *node) outOfDateNoMemo(db *Database, hash bool, dynamic bool) UpdateReas
 
 	// if a prereq is out of date, this rule is out of date
 	order := false
+	elided := false
 	for _, p := range n.prereqs {
 		ood := p.outOfDate(db, hash, false)
 		// if the only prereqs out of date are order-only, then we just run
 		// them but this rule does not need to rebuild
 		if !p.rule.attrs.Order && ood != UpToDate && ood != OnlyPrereqs {
-			if dynamic {
+			if dynamic && hash {
 				return UpToDateDynamic
 			}
+			// without hashing, only prereqs that were found to not modify
+			// their outputs can be elided
+			if dynamic && p.unchanged {
+				elided = true
+				continue
+			}
 			return Prereq
 		}
 		if ood != UpToDate {
 			order = true
 		}
 	}
+	if elided {
+		return UpToDateDynamic
+	}
 	if order {
 		return OnlyPrereqs
 	}
 	return UpToDate
 }
 
+// recipeDiff returns a diff between the recipe that was last recorded for this
+// node and its current recipe, or false if no recipe has been recorded.
+func (n *node) recipeDiff(db *Database) ([]string, bool) {
+	old, ok := db.Recipes.text(n.rule.targets, n.dir)
+	if !ok {
+		return nil, false
+	}
+	return diffLines(old, n.recipe), true
+}
+
 func (n *node) count(db *Database, full, hash bool, counted map[*info]bool) int {
 	s := 0
 	ood := n.outOfDate(db, hash, false)
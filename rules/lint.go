@@ -0,0 +1,349 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The checks performed by the lint tool, in the order that they are reported.
+var lintChecks = []string{
+	"graph",
+	"missing-prereq",
+	"virtual-prereq",
+	"unused-io",
+	"outside-output",
+	"duplicate-target",
+	"unused-meta",
+	"expansion",
+	"unreachable",
+}
+
+// A LintProblem is a possible mistake in the rules, found by the lint tool.
+type LintProblem struct {
+	Check    string `json:"check"`
+	Location string `json:"location,omitempty"`
+	Message  string `json:"message"`
+
+	file string
+	line int
+}
+
+type LintTool struct {
+	W io.Writer
+}
+
+type linter struct {
+	rs       *RuleSet
+	problems []LintProblem
+	seen     map[LintProblem]bool
+}
+
+func (l *linter) report(check string, r *baseRule, format string, args ...interface{}) {
+	p := LintProblem{
+		Check:   check,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if r != nil {
+		p.Location = r.Location()
+		p.file = r.file
+		p.line = r.line
+	}
+	if l.seen[p] {
+		return
+	}
+	l.seen[p] = true
+	l.problems = append(l.problems, p)
+}
+
+// Returns true if some rule can build 'target'.
+func (l *linter) isTarget(target string) bool {
+	if _, ok := l.rs.targets[target]; ok {
+		return true
+	}
+	for _, mr := range l.rs.metaRules {
+		reltarget, err := rel(mr.dir, target)
+		if err != nil {
+			continue
+		}
+		if sub, _ := mr.Match(reltarget); sub != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if 'target' is built by a virtual direct rule.
+func (l *linter) isVirtual(target string) bool {
+	for _, ri := range l.rs.targets[target] {
+		if l.rs.directRules[ri].attrs.Virtual {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linter) checkPrereqs(r *DirectRule) {
+	for _, p := range r.prereqs {
+		if p.attrs.Glob || p.attrs.Generated || p.attrs.Listing {
+			continue
+		}
+		full := pathJoin(r.dir, p.name)
+		if alt, ok := l.rs.buildPath(full); ok && l.isTarget(alt) {
+			full = alt
+		}
+		if !l.isTarget(full) {
+			if !exists(full) {
+				l.report("missing-prereq", &r.baseRule, "prereq '%s' is neither a file nor a target", p.name)
+			}
+			continue
+		}
+		if !r.attrs.Virtual && len(r.recipe) != 0 && !p.attrs.Implicit && l.isVirtual(full) {
+			l.report("virtual-prereq", &r.baseRule, "prereq '%s' is a virtual target, but is used as a file in $input", p.name)
+		}
+	}
+}
+
+var ioRegex = regexp.MustCompile(`\$[{(]?\s*(input|output)s?\b`)
+
+func (l *linter) checkRecipe(r *baseRule) {
+	if r.attrs.Virtual || r.fn != nil || len(r.recipe) == 0 {
+		return
+	}
+	for _, c := range r.recipe {
+		if ioRegex.MatchString(c) {
+			return
+		}
+	}
+	l.report("unused-io", r, "recipe never references $output or $input")
+}
+
+func (l *linter) checkOutputs(r *DirectRule) {
+	if r.attrs.Virtual {
+		return
+	}
+	for _, t := range r.targets {
+		t = filepath.ToSlash(filepath.Clean(t))
+		if filepath.IsAbs(t) || t == ".." || strings.HasPrefix(t, "../") {
+			l.report("outside-output", &r.baseRule, "output '%s' is outside of the buildset directory '%s'", t, r.dir)
+		}
+	}
+}
+
+func (l *linter) checkDuplicates() {
+	targets := make([]string, 0, len(l.rs.targets))
+	for t := range l.rs.targets {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	for _, t := range targets {
+		var prev *DirectRule
+		for _, ri := range l.rs.targets[t] {
+			r := &l.rs.directRules[ri]
+			if len(r.recipe) == 0 {
+				continue
+			}
+			if prev != nil {
+				l.report("duplicate-target", &r.baseRule, "recipe for '%s' overrides the one at %s", t, prev.Location())
+			}
+			prev = r
+		}
+	}
+}
+
+// Expands the recipes of 'n' and the nodes it depends on, reporting each
+// recipe that cannot be expanded.
+func (l *linter) expand(vm VM, n *node, inherited []targetVar, visited map[*info]bool) {
+	if visited[n.info] {
+		return
+	}
+	visited[n.info] = true
+	if err := n.expandNode(vm, inherited); err != nil {
+		l.report("expansion", &n.rule.baseRule, "recipe for '%s' cannot be expanded: %v", n2str(n), err)
+	}
+	vars := n.propagated()
+	for _, p := range n.prereqs {
+		l.expand(vm, p, vars, visited)
+	}
+}
+
+// Marks the nodes that 'n' depends on.
+func markDeps(n *node, deps map[*info]bool) {
+	for _, p := range n.prereqs {
+		if !deps[p.info] {
+			deps[p.info] = true
+			markDeps(p, deps)
+		}
+	}
+}
+
+// Runs the checks that need the graph of all targets: which targets can be
+// resolved, which meta-rules are used, and which recipes can be expanded.
+// Each target is resolved on its own so that one failure does not hide the
+// others.
+func (l *linter) checkGraph(g *Graph) {
+	all := newGraph(l.rs, g.updated)
+	all.usedMeta = make(map[int]bool)
+
+	targets := make([]string, 0, len(l.rs.targets))
+	for t := range l.rs.targets {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+	var nodes []*node
+	for _, t := range targets {
+		ris := l.rs.targets[t]
+		r := &l.rs.directRules[ris[len(ris)-1]]
+		if r.file == "" {
+			continue
+		}
+		n, err := all.resolve(t)
+		if err != nil {
+			l.report("graph", &r.baseRule, "'%s' cannot be built: %v", t, err)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+
+	for mi := range l.rs.metaRules {
+		mr := &l.rs.metaRules[mi]
+		if mr.file != "" && !all.usedMeta[mi] {
+			l.report("unused-meta", &mr.baseRule, "meta-rule '%s' is not used to build any target", mr.String())
+		}
+	}
+
+	if g.vm == nil {
+		return
+	}
+	// expand the nodes that no other node depends on first, so that their
+	// variables are propagated to their prereqs
+	deps := make(map[*info]bool)
+	for _, n := range nodes {
+		markDeps(n, deps)
+	}
+	visited := make(map[*info]bool)
+	for _, n := range nodes {
+		if !deps[n.info] {
+			l.expand(g.vm, n, nil, visited)
+		}
+	}
+	for _, n := range nodes {
+		l.expand(g.vm, n, nil, visited)
+	}
+}
+
+// Reports the file rules that the main target does not depend on. The ':all'
+// target depends on every rule, so reachability is checked from the main
+// target instead.
+func (l *linter) checkReachable(g *Graph) {
+	main := l.rs.MainTarget()
+	if main == "" {
+		return
+	}
+	mg := newGraph(l.rs, g.updated)
+	if _, err := mg.resolve(main); err != nil {
+		return
+	}
+	for ri := range l.rs.directRules {
+		r := &l.rs.directRules[ri]
+		if r.file == "" || r.attrs.Virtual {
+			continue
+		}
+		reachable := false
+		for _, t := range r.targets {
+			t = pathJoin(r.dir, t)
+			_, ok := mg.nodes[t]
+			_, full := mg.fullNodes[t]
+			reachable = reachable || ok || full
+		}
+		if !reachable {
+			l.report("unreachable", &r.baseRule, "'%s' is not needed by the main target '%s'", strings.Join(r.targets, " "), main)
+		}
+	}
+}
+
+func (l *linter) lint(g *Graph) {
+	for ri := range l.rs.directRules {
+		r := &l.rs.directRules[ri]
+		if r.file == "" {
+			continue
+		}
+		l.checkPrereqs(r)
+		l.checkRecipe(&r.baseRule)
+		l.checkOutputs(r)
+	}
+	for mi := range l.rs.metaRules {
+		l.checkRecipe(&l.rs.metaRules[mi].baseRule)
+	}
+	l.checkDuplicates()
+	l.checkGraph(g)
+	l.checkReachable(g)
+}
+
+func (t *LintTool) Run(g *Graph, args []string) error {
+	format := "text"
+	if len(args) > 0 {
+		format = args[0]
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid argument '%s', must be one of: text, json", format)
+	}
+
+	// a graph that joins the builds of several variants has a graph for each
+	// variant below its root
+	graphs := []*Graph{g}
+	if g.vm == nil && g.base != nil {
+		graphs = graphs[:0]
+		for _, p := range g.base.prereqs {
+			graphs = append(graphs, p.graph)
+		}
+	}
+	l := &linter{
+		problems: []LintProblem{},
+		seen:     make(map[LintProblem]bool),
+	}
+	for _, sub := range graphs {
+		l.rs = sub.rules
+		l.lint(sub)
+	}
+
+	order := make(map[string]int)
+	for i, c := range lintChecks {
+		order[c] = i
+	}
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		a, b := l.problems[i], l.problems[j]
+		if order[a.Check] != order[b.Check] {
+			return order[a.Check] < order[b.Check]
+		}
+		if a.file != b.file {
+			return a.file < b.file
+		}
+		return a.line < b.line
+	})
+
+	if format == "json" {
+		data, err := json.Marshal(l.problems)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(t.W, string(data))
+		return nil
+	}
+	for _, p := range l.problems {
+		if p.Location != "" {
+			fmt.Fprintf(t.W, "%s: %s (%s)\n", p.Location, p.Message, p.Check)
+		} else {
+			fmt.Fprintf(t.W, "%s (%s)\n", p.Message, p.Check)
+		}
+	}
+	return nil
+}
+
+func (t *LintTool) String() string {
+	return "lint - check the rules for likely mistakes (formats: text, json)"
+}
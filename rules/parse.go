@@ -204,6 +204,10 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	var meta bool
 
 	base.dir = p.rules.dir
+	base.file = p.file
+	if len(p.tokenbuf) > 0 {
+		base.line = p.tokenbuf[0].line
+	}
 
 	// find one or two colons
 	i := 0
@@ -225,6 +229,9 @@ func parseRecipe(p *parser, t token) parserStateFun {
 			p.basicErrorAtToken(msg, p.tokenbuf[i+1])
 		}
 		base.attrs = attrs
+		if !attrs.Virtual {
+			p.rules.outputAttrs(&base.attrs)
+		}
 
 		if base.attrs.Regex {
 			meta = true
@@ -241,8 +248,10 @@ func parseRecipe(p *parser, t token) parserStateFun {
 			if strings.ContainsRune(str, '%') {
 				meta = true
 				break
-			} else {
+			} else if base.attrs.Virtual {
 				direct = append(direct, filepath.Clean(str))
+			} else {
+				direct = append(direct, p.rules.output(filepath.Clean(str), false))
 			}
 		}
 	}
@@ -251,39 +260,41 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	if meta {
 		for k := 0; k < i; k++ {
 			str := p.tokenbuf[k].val
-			if base.attrs.Regex {
-				rpat, err := regexp.Compile("^" + str + "$")
-				if err != nil {
-					msg := fmt.Sprintf("invalid regular expression: %q", err)
-					p.basicErrorAtToken(msg, p.tokenbuf[k])
-				}
-				patterns = append(patterns, Pattern{
-					Regex: rpat,
-				})
-			} else {
-				idx := strings.IndexRune(str, '%')
-				if idx >= 0 {
-					var left, right string
-					if idx > 0 {
-						left = regexp.QuoteMeta(str[:idx])
-					}
-					if idx < len(str)-1 {
-						right = regexp.QuoteMeta(str[idx+1:])
-					}
-
-					patstr := fmt.Sprintf("^%s(.*)%s$", left, right)
-					rpat, err := regexp.Compile(patstr)
-					if err != nil {
-						msg := fmt.Sprintf("error compiling suffix rule - this is a bug - error: %s", err)
-						p.basicErrorAtToken(msg, p.tokenbuf[k])
-					}
-					patterns = append(patterns, Pattern{
-						Regex:  rpat,
-						Suffix: true,
-					})
-				}
+			if !base.attrs.Regex && !strings.ContainsRune(str, '%') {
+				continue
 			}
+			if !base.attrs.Virtual {
+				str = p.rules.output(str, base.attrs.Regex)
+			}
+			pat, err := newPattern(str, base.attrs.Regex)
+			if err != nil {
+				p.basicErrorAtToken(err.Error(), p.tokenbuf[k])
+				continue
+			}
+			patterns = append(patterns, pat)
+		}
+	}
+
+	// a rule of the form 'targets: name = value' binds a variable
+	if v, ok := p.assignment(j + 1); ok {
+		if t.typ == tokenRecipe {
+			p.basicErrorAtToken("variable assignment cannot have a recipe", p.tokenbuf[0])
 		}
+		if meta {
+			v.patterns = patterns
+		} else {
+			v.targets = direct
+		}
+		v.dir = base.dir
+		v.propagate = base.attrs.Propagate
+		v.file = base.file
+		v.line = base.line
+		p.rules.addVar(v)
+		p.clear()
+		if t.typ != tokenRecipe {
+			return parseTopLevel(p, t)
+		}
+		return parseTopLevel
 	}
 
 	// prereqs
@@ -299,15 +310,22 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		k++
 		switch t.typ {
 		case tokenLSquare:
-			// second [
-			if k < len(p.tokenbuf) && p.tokenbuf[k].typ == tokenLSquare {
-				k++
-				for k < len(p.tokenbuf) && p.tokenbuf[k].typ != tokenRSquare {
-					p, n := getPrereq(k)
-					prereqs = append(prereqs, p...)
-					k = n
-				}
+			// a group of prereqs, as in '[a b][attrs]' or '[[a b]][attrs]'
+			double := k < len(p.tokenbuf) && p.tokenbuf[k].typ == tokenLSquare
+			if double {
 				k++
+			}
+			for k < len(p.tokenbuf) && p.tokenbuf[k].typ != tokenRSquare {
+				p, n := getPrereq(k)
+				prereqs = append(prereqs, p...)
+				k = n
+			}
+			if k >= len(p.tokenbuf) {
+				p.basicErrorAtToken("did not find ']' to close '[' list", t)
+				return prereqs, k
+			}
+			k++
+			if double {
 				if !(k < len(p.tokenbuf) && p.tokenbuf[k].typ == tokenRSquare) {
 					if k >= len(p.tokenbuf) {
 						k = len(p.tokenbuf) - 1
@@ -391,6 +409,65 @@ func parseRecipe(p *parser, t token) parserStateFun {
 	return parseTopLevel
 }
 
+var assignRegex = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)\s*(\+?=)\s*(.*)$`)
+
+// Returns the variable assignment, as in 'name = value' or 'name += value',
+// made by the words of the current statement starting at 'k'.
+func (p *parser) assignment(k int) (targetVar, bool) {
+	words := make([]string, 0, len(p.tokenbuf)-k)
+	for ; k < len(p.tokenbuf); k++ {
+		if p.tokenbuf[k].typ != tokenWord {
+			return targetVar{}, false
+		}
+		words = append(words, p.tokenbuf[k].val)
+	}
+	m := assignRegex.FindStringSubmatch(strings.Join(words, " "))
+	if m == nil {
+		return targetVar{}, false
+	}
+	return targetVar{
+		name:   m[1],
+		value:  m[3],
+		append: m[2] == "+=",
+	}, true
+}
+
+// Compiles a meta-rule target into a pattern. If 'regex' is false, the target
+// must contain a '%', which matches any string.
+func newPattern(str string, regex bool) (Pattern, error) {
+	if regex {
+		rpat, err := regexp.Compile("^" + str + "$")
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid regular expression: %q", err)
+		}
+		return Pattern{
+			Regex: rpat,
+		}, nil
+	}
+
+	idx := strings.IndexRune(str, '%')
+	if idx < 0 {
+		return Pattern{}, fmt.Errorf("pattern '%s' does not contain '%%'", str)
+	}
+	var left, right string
+	if idx > 0 {
+		left = regexp.QuoteMeta(str[:idx])
+	}
+	if idx < len(str)-1 {
+		right = regexp.QuoteMeta(str[idx+1:])
+	}
+
+	patstr := fmt.Sprintf("^%s(.*)%s$", left, right)
+	rpat, err := regexp.Compile(patstr)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("error compiling suffix rule - this is a bug - error: %s", err)
+	}
+	return Pattern{
+		Regex:  rpat,
+		Suffix: true,
+	}, nil
+}
+
 func parseCommands(recipe string) []string {
 	commands := make([]string, 0)
 	rd := strings.NewReader(recipe)
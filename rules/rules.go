@@ -3,7 +3,9 @@ package rules
 import (
 	"bytes"
 	"fmt"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -16,10 +18,21 @@ type baseRule struct {
 	attrs   AttrSet
 	recipe  []string
 	dir     string
+	// if non-nil, the recipe is this function rather than the commands
+	fn FuncRecipe
+
+	// location where the rule was defined
+	file string
+	line int
 }
 
 func (b baseRule) isRule() {}
 
+// Location returns the file and line where the rule was defined.
+func (b *baseRule) Location() string {
+	return fmt.Sprintf("%s:%d", b.file, b.line)
+}
+
 func (b *baseRule) prereqsString() string {
 	buf := &bytes.Buffer{}
 	for i, p := range b.prereqs {
@@ -71,6 +84,7 @@ func equal[T comparable](a, b []T) bool {
 
 func (r *DirectRule) Equals(other *DirectRule) bool {
 	return r.attrs == other.attrs &&
+		r.fn == other.fn &&
 		equal(r.prereqs, other.prereqs) &&
 		equal(r.recipe, other.recipe)
 }
@@ -110,16 +124,40 @@ func (r *MetaRule) String() string {
 }
 
 type AttrSet struct {
-	Regex    bool   // regular expression meta-rule
-	Virtual  bool   // targets are not files
-	Quiet    bool   // is not displayed as part of the build process
-	NoMeta   bool   // cannot be matched by meta rules
-	NonStop  bool   // does not stop if the recipe fails
-	Rebuild  bool   // this rule is always out-of-date
-	Linked   bool   // only run this rule if a sub-rule that requires it needs to run
-	Implicit bool   // not listed in $input
-	Dep      string // dependency file
-	Order    bool
+	Regex       bool   // regular expression meta-rule
+	Virtual     bool   // targets are not files
+	Quiet       bool   // is not displayed as part of the build process
+	NoMeta      bool   // cannot be matched by meta rules
+	NonStop     bool   // does not stop if the recipe fails
+	Rebuild     bool   // this rule is always out-of-date
+	Linked      bool   // only run this rule if a sub-rule that requires it needs to run
+	Implicit    bool   // not listed in $input
+	Interactive bool   // the recipe may read from stdin
+	Restat      bool   // dependents are up-to-date if the recipe doesn't modify the outputs
+	Shell       bool   // the recipe must be run by a real shell
+	OneShell    bool   // the recipe is run as a single shell script
+	Dep         string // dependency file
+	Dyndep      string // dependency file that is built during the build
+	Manifest    string // file listing the outputs of a generator
+	Generated   bool   // prereq is a pattern over the files listed by a generator
+	Glob        bool   // prereq is a glob pattern that is expanded when the graph is built
+	Listing     bool   // only the listing of the prereq directory is tracked
+	Propagate   bool   // target variables also apply to the prereqs of the targets
+	Env         string // comma-separated environment variables used by the recipe
+	Order       bool
+}
+
+// EnvVars returns the list of environment variables that the recipe depends
+// on.
+func (a *AttrSet) EnvVars() []string {
+	if a.Env == "" {
+		return nil
+	}
+	vars := strings.Split(a.Env, ",")
+	for i, v := range vars {
+		vars[i] = strings.TrimSpace(v)
+	}
+	return vars
 }
 
 func (a *AttrSet) UpdateFrom(other AttrSet) {
@@ -132,6 +170,14 @@ func (a *AttrSet) UpdateFrom(other AttrSet) {
 	a.Linked = a.Linked || other.Linked
 	a.Order = a.Order || other.Order
 	a.Implicit = a.Implicit || other.Implicit
+	a.Interactive = a.Interactive || other.Interactive
+	a.Restat = a.Restat || other.Restat
+	a.Shell = a.Shell || other.Shell
+	a.OneShell = a.OneShell || other.OneShell
+	a.Generated = a.Generated || other.Generated
+	a.Glob = a.Glob || other.Glob
+	a.Listing = a.Listing || other.Listing
+	a.Propagate = a.Propagate || other.Propagate
 }
 
 type Pattern struct {
@@ -147,6 +193,51 @@ type RuleSet struct {
 	// a target may have multiple rules implementing it
 	// a rule may have multiple targets pointing to it
 	targets map[string][]int
+	// variables bound to targets, in the order they were defined
+	vars []targetVar
+	// directory that the outputs of the rules are written to, relative to
+	// dir, or empty if they are written to dir
+	builddir string
+	// build directories of the merged rule sets, by their directory
+	builddirs map[string]string
+}
+
+// A targetVar binds a variable to some targets, or to the targets that match
+// some patterns. The variable is set while the recipes that build those
+// targets are expanded.
+type targetVar struct {
+	targets  []string // relative to dir
+	patterns []Pattern
+	dir      string
+
+	name   string
+	value  string
+	append bool // the value is appended to the current value
+	// the variable is also set for the prereqs of the targets
+	propagate bool
+
+	file string
+	line int
+}
+
+// Returns true if the variable is bound to 'target', which is relative to
+// the current directory.
+func (v *targetVar) matches(target string) bool {
+	reltarget, err := rel(v.dir, target)
+	if err != nil {
+		return false
+	}
+	for _, t := range v.targets {
+		if t == reltarget {
+			return true
+		}
+	}
+	for _, p := range v.patterns {
+		if p.Regex.MatchString(reltarget) {
+			return true
+		}
+	}
+	return false
 }
 
 type prereq struct {
@@ -182,6 +273,106 @@ func (rs *RuleSet) Add(r Rule) {
 	}
 }
 
+// CheckBuildDir returns an error if 'dir' cannot be the build directory of a
+// rule set: it must be a relative path inside the rule set's directory, since
+// the build directory is removed when cleaning.
+func CheckBuildDir(dir string) error {
+	clean := filepath.Clean(dir)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("build directory '%s' is not inside the buildset directory", dir)
+	}
+	return nil
+}
+
+// SetBuildDir sets the directory, relative to the rule set's directory, that the
+// outputs of its rules are written to. It must be set before rules are added.
+func (rs *RuleSet) SetBuildDir(dir string) error {
+	if err := CheckBuildDir(dir); err != nil {
+		return err
+	}
+	if dir = filepath.Clean(dir); dir != "." {
+		rs.builddir = dir
+	}
+	return nil
+}
+
+// Returns the output 'name' of a rule in the rule set, rooted in the build
+// directory if there is one. If 'regex' is true the name is a regular
+// expression.
+func (rs *RuleSet) output(name string, regex bool) string {
+	if rs.builddir == "" || name == "" || filepath.IsAbs(name) {
+		return name
+	} else if regex {
+		return regexp.QuoteMeta(filepath.ToSlash(rs.builddir)+"/") + name
+	}
+	return filepath.Join(rs.builddir, name)
+}
+
+// Roots the files that a rule with the attributes 'attrs' writes in the build
+// directory.
+func (rs *RuleSet) outputAttrs(attrs *AttrSet) {
+	attrs.Dep = rs.output(attrs.Dep, false)
+	attrs.Dyndep = rs.output(attrs.Dyndep, false)
+	attrs.Manifest = rs.output(attrs.Manifest, false)
+}
+
+// Returns the path of 'target' in the build directory of the rule set that
+// contains it, if that rule set has a build directory and 'target' is not
+// already in it.
+func (rs *RuleSet) buildPath(target string) (string, bool) {
+	var dir, builddir string
+	found := false
+	for d, b := range rs.builddirs {
+		r, err := filepath.Rel(d, target)
+		if err != nil || r == ".." || strings.HasPrefix(r, "../") || filepath.IsAbs(target) {
+			continue
+		}
+		if !found || len(d) > len(dir) {
+			dir, builddir, found = d, b, true
+		}
+	}
+	if !found || builddir == "" {
+		return "", false
+	}
+	r, _ := filepath.Rel(dir, target)
+	if r == builddir || strings.HasPrefix(r, builddir+"/") {
+		return "", false
+	}
+	return filepath.Join(dir, builddir, r), true
+}
+
+func (rs *RuleSet) addVar(v targetVar) {
+	rs.vars = append(rs.vars, v)
+}
+
+// CheckExpanded returns an error if a variable that is bound to targets was
+// already expanded from Lua when a rule was created, since the binding then
+// has no effect on that rule. The 'expanded' variables map to the location of
+// the rule that expanded them.
+func (rs *RuleSet) CheckExpanded(expanded map[string]string) error {
+	for _, v := range rs.vars {
+		if loc, ok := expanded[v.name]; ok {
+			return fmt.Errorf("%s:%d: variable '%s' is bound to targets, but the rules at %s expand the Lua variable of that name instead", v.file, v.line, v.name, loc)
+		}
+	}
+	return nil
+}
+
+// Returns the variables that are bound to any of 'targets', which are
+// relative to 'dir'.
+func (rs *RuleSet) varsFor(dir string, targets []string) []targetVar {
+	var vars []targetVar
+	for _, v := range rs.vars {
+		for _, t := range targets {
+			if v.matches(pathJoin(dir, t)) {
+				vars = append(vars, v)
+				break
+			}
+		}
+	}
+	return vars
+}
+
 func (rs *RuleSet) MainTarget() string {
 	if len(rs.directRules) == 0 || len(rs.directRules[0].targets) == 0 {
 		return ""
@@ -205,6 +396,26 @@ func (err attrError) Error() string {
 	return fmt.Sprintf("unrecognized attribute: %c", err.found)
 }
 
+// Reads the bracketed argument of the attribute 'attr', as in 'D[file]'.
+func parseAttribArg(r *strings.Reader, attr rune) (string, error) {
+	if r.Len() == 0 {
+		return "", fmt.Errorf("attribute: no contents found after %c", attr)
+	}
+	c, _, _ := r.ReadRune()
+	if c != '[' {
+		return "", fmt.Errorf("attribute: no '[' found after %c", attr)
+	}
+	arg := &bytes.Buffer{}
+	for r.Len() > 0 {
+		c, _, _ = r.ReadRune()
+		if c == ']' {
+			return arg.String(), nil
+		}
+		arg.WriteRune(c)
+	}
+	return "", fmt.Errorf("attribute: no ']' found after %c", attr)
+}
+
 func ParseAttribs(input string) (AttrSet, error) {
 	var attrs AttrSet
 	r := strings.NewReader(input)
@@ -229,29 +440,46 @@ func ParseAttribs(input string) (AttrSet, error) {
 			attrs.Order = true
 		case 'I':
 			attrs.Implicit = true
+		case 'T':
+			attrs.Interactive = true
+		case 'S':
+			attrs.Restat = true
+		case 'X':
+			attrs.Shell = true
+		case 'U':
+			attrs.OneShell = true
 		case 'D':
-			if r.Len() == 0 {
-				return attrs, fmt.Errorf("attribute: no contents found after D")
+			dep, err := parseAttribArg(r, c)
+			if err != nil {
+				return attrs, err
+			}
+			attrs.Dep = dep
+		case 'Y':
+			dyndep, err := parseAttribArg(r, c)
+			if err != nil {
+				return attrs, err
 			}
-			c, _, _ = r.ReadRune()
-			dep := &bytes.Buffer{}
-			if c == '[' {
-				found := false
-				for r.Len() > 0 {
-					c, _, _ = r.ReadRune()
-					if c == ']' {
-						found = true
-						break
-					}
-					dep.WriteRune(c)
-				}
-				if !found {
-					return attrs, fmt.Errorf("attribute: no ']' found after D")
-				}
-			} else {
-				return attrs, fmt.Errorf("attribute: no '[' found after D")
+			attrs.Dyndep = dyndep
+		case 'W':
+			manifest, err := parseAttribArg(r, c)
+			if err != nil {
+				return attrs, err
 			}
-			attrs.Dep = dep.String()
+			attrs.Manifest = manifest
+		case 'F':
+			attrs.Generated = true
+		case 'G':
+			attrs.Glob = true
+		case 'K':
+			attrs.Listing = true
+		case 'P':
+			attrs.Propagate = true
+		case 'N':
+			env, err := parseAttribArg(r, c)
+			if err != nil {
+				return attrs, err
+			}
+			attrs.Env = env
 		default:
 			return attrs, attrError{c}
 		}
@@ -260,16 +488,243 @@ func ParseAttribs(input string) (AttrSet, error) {
 	return attrs, nil
 }
 
+// Long names of the boolean attributes, used when rules are constructed
+// directly from Lua.
+var attrFlags = []struct {
+	name string
+	flag func(a *AttrSet) *bool
+}{
+	{"quiet", func(a *AttrSet) *bool { return &a.Quiet }},
+	{"regex", func(a *AttrSet) *bool { return &a.Regex }},
+	{"virtual", func(a *AttrSet) *bool { return &a.Virtual }},
+	{"nometa", func(a *AttrSet) *bool { return &a.NoMeta }},
+	{"nonstop", func(a *AttrSet) *bool { return &a.NonStop }},
+	{"rebuild", func(a *AttrSet) *bool { return &a.Rebuild }},
+	{"linked", func(a *AttrSet) *bool { return &a.Linked }},
+	{"order", func(a *AttrSet) *bool { return &a.Order }},
+	{"implicit", func(a *AttrSet) *bool { return &a.Implicit }},
+	{"interactive", func(a *AttrSet) *bool { return &a.Interactive }},
+	{"restat", func(a *AttrSet) *bool { return &a.Restat }},
+	{"shell", func(a *AttrSet) *bool { return &a.Shell }},
+	{"oneshell", func(a *AttrSet) *bool { return &a.OneShell }},
+	{"generated", func(a *AttrSet) *bool { return &a.Generated }},
+	{"glob", func(a *AttrSet) *bool { return &a.Glob }},
+	{"listing", func(a *AttrSet) *bool { return &a.Listing }},
+	{"propagate", func(a *AttrSet) *bool { return &a.Propagate }},
+}
+
+// SetFlag sets the boolean attribute with the long name 'name'.
+func (a *AttrSet) SetFlag(name string, val bool) error {
+	for _, f := range attrFlags {
+		if f.name == name {
+			*f.flag(a) = val
+			return nil
+		}
+	}
+	return fmt.Errorf("attribute: unknown flag '%s'", name)
+}
+
+// SetArg sets the attribute with the long name 'name' that takes an argument.
+func (a *AttrSet) SetArg(name string, val string) error {
+	switch name {
+	case "dep":
+		a.Dep = val
+	case "dyndep":
+		a.Dyndep = val
+	case "manifest":
+		a.Manifest = val
+	case "env":
+		a.Env = val
+	default:
+		return fmt.Errorf("attribute: unknown argument attribute '%s'", name)
+	}
+	return nil
+}
+
+// A FuncRecipe is a recipe that is implemented by a function rather than by
+// shell commands.
+type FuncRecipe interface {
+	// Text returns the text that is recorded as the recipe. It must change
+	// whenever the function changes.
+	Text() string
+	// String returns a description of the function that is displayed when it
+	// runs.
+	String() string
+	// Run executes the function for a build step.
+	Run(args FuncArgs) error
+}
+
+// FuncArgs are the values that a FuncRecipe is run with. Paths are relative to
+// the directory that Knit runs in.
+type FuncArgs struct {
+	Inputs  []string
+	Outputs []string
+	Match   string
+	Matches []string
+	Dep     string
+	// target variables that are set for the step
+	Vars map[string]string
+}
+
+// A RuleSpec describes a rule by its parts, so that it can be added to a rule
+// set without being parsed. Targets and prereqs are used literally.
+type RuleSpec struct {
+	Targets []string
+	// if there are patterns, the rule is a meta-rule
+	Patterns []string
+	Prereqs  []string
+	Recipe   []string
+	Func     FuncRecipe // used instead of Recipe if non-nil
+	Attrs    AttrSet
+	// variables bound to the targets or patterns
+	Vars map[string]string
+
+	// location where the rule was defined
+	File string
+	Line int
+}
+
+// AddSpec adds the rule described by 'spec' to the rule set.
+func (rs *RuleSet) AddSpec(spec RuleSpec) error {
+	base := baseRule{
+		prereqs: make([]prereq, 0, len(spec.Prereqs)),
+		attrs:   spec.Attrs,
+		recipe:  spec.Recipe,
+		dir:     rs.dir,
+		file:    spec.File,
+		line:    spec.Line,
+	}
+	if spec.Func != nil {
+		base.fn = spec.Func
+		base.recipe = []string{spec.Func.Text()}
+	}
+	if !spec.Attrs.Virtual {
+		rs.outputAttrs(&base.attrs)
+	}
+	for _, p := range spec.Prereqs {
+		base.prereqs = append(base.prereqs, prereq{name: filepath.Clean(p)})
+	}
+
+	if len(spec.Targets) != 0 && len(spec.Patterns) != 0 {
+		return fmt.Errorf("%s: rule cannot have both targets and patterns", base.Location())
+	} else if len(spec.Targets) == 0 && len(spec.Patterns) == 0 {
+		return fmt.Errorf("%s: rule has no targets", base.Location())
+	} else if spec.Attrs.Regex && len(spec.Patterns) == 0 {
+		return fmt.Errorf("%s: regex rule must use patterns", base.Location())
+	}
+
+	var patterns []Pattern
+	for _, str := range spec.Patterns {
+		if !spec.Attrs.Virtual {
+			str = rs.output(str, spec.Attrs.Regex)
+		}
+		pat, err := newPattern(str, spec.Attrs.Regex)
+		if err != nil {
+			return fmt.Errorf("%s: %w", base.Location(), err)
+		}
+		patterns = append(patterns, pat)
+	}
+	targets := make([]string, 0, len(spec.Targets))
+	for _, t := range spec.Targets {
+		t = filepath.Clean(t)
+		if !spec.Attrs.Virtual {
+			t = rs.output(t, false)
+		}
+		targets = append(targets, t)
+	}
+
+	names := make([]string, 0, len(spec.Vars))
+	for name := range spec.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// a name ending in '+' appends to the variable, like '+='
+		rs.addVar(targetVar{
+			targets:   targets,
+			patterns:  patterns,
+			dir:       rs.dir,
+			name:      strings.TrimSuffix(name, "+"),
+			value:     spec.Vars[name],
+			append:    strings.HasSuffix(name, "+"),
+			propagate: spec.Attrs.Propagate,
+			file:      spec.File,
+			line:      spec.Line,
+		})
+	}
+	if len(spec.Vars) != 0 && len(spec.Prereqs) == 0 && len(spec.Recipe) == 0 && spec.Func == nil {
+		// the rule only binds variables
+		return nil
+	}
+
+	if len(patterns) != 0 {
+		rs.Add(MetaRule{
+			baseRule: base,
+			targets:  patterns,
+			nomatch:  make(map[string]bool),
+		})
+		return nil
+	}
+
+	rs.Add(DirectRule{
+		baseRule: base,
+		targets:  targets,
+	})
+	return nil
+}
+
+// String returns the Lua code that constructs the rule.
+func (s *RuleSpec) String() string {
+	recipe := s.Recipe
+	if s.Func != nil {
+		recipe = []string{funcComment(s.Func)}
+	}
+	return luaRule(s.Targets, s.Patterns, s.Prereqs, recipe, s.Vars, s.Attrs)
+}
+
+// Returns a shell comment that stands in for a function recipe in output
+// that can only contain commands.
+func funcComment(fn FuncRecipe) string {
+	return "# " + fn.String()
+}
+
+// Named returns the attributes that are set, by their long names. Flags map to
+// true and attributes with arguments map to their argument.
+func (a *AttrSet) Named() map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, f := range attrFlags {
+		if *f.flag(a) {
+			attrs[f.name] = true
+		}
+	}
+	if a.Dep != "" {
+		attrs["dep"] = a.Dep
+	}
+	if a.Dyndep != "" {
+		attrs["dyndep"] = a.Dyndep
+	}
+	if a.Manifest != "" {
+		attrs["manifest"] = a.Manifest
+	}
+	if a.Env != "" {
+		attrs["env"] = a.Env
+	}
+	return attrs
+}
+
 func MergeRuleSets(first *RuleSet, rsets []*RuleSet) *RuleSet {
 	rs := NewRuleSet(".")
+	rs.builddirs = make(map[string]string)
 
 	add := func(r *RuleSet) {
+		rs.builddirs[r.dir] = r.builddir
 		for _, mr := range r.metaRules {
 			rs.Add(mr)
 		}
 		for _, dr := range r.directRules {
 			rs.Add(dr)
 		}
+		rs.vars = append(rs.vars, r.vars...)
 	}
 
 	add(first)
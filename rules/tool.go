@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -28,6 +29,10 @@ var tools = []Tool{
 	&StatusTool{},
 	&PathTool{},
 	&DbTool{},
+	&RecipeDiffTool{},
+	&ResolveTool{},
+	&LintTool{},
+	&OptionsTool{},
 }
 
 type Tool interface {
@@ -170,7 +175,33 @@ func (t *CleanTool) removeEmpty(dir string) error {
 }
 
 func (t *CleanTool) Run(g *Graph, args []string) error {
+	// build directories only contain outputs, so they are removed entirely
+	builddirs := g.buildDirs()
+	for _, d := range builddirs {
+		if !t.NoExec {
+			if err := os.RemoveAll(d); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+		}
+		fmt.Fprintln(t.W, "remove", d)
+	}
+	inBuildDir := func(path string) bool {
+		for _, d := range builddirs {
+			if path == d || strings.HasPrefix(path, d+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+
 	for o := range t.Db.Outputs {
+		if inBuildDir(o) {
+			if !t.NoExec {
+				delete(t.Db.Outputs, o)
+			}
+			continue
+		}
 		if !t.NoExec {
 			err := os.RemoveAll(o)
 			delete(t.Db.Outputs, o)
@@ -182,6 +213,9 @@ func (t *CleanTool) Run(g *Graph, args []string) error {
 		fmt.Fprintln(t.W, "remove", o)
 	}
 	for o := range t.Db.OutputDirs {
+		if inBuildDir(o) {
+			continue
+		}
 		err := t.removeEmpty(o)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
@@ -313,7 +347,7 @@ func (r BuildRules) toMake(w io.Writer) {
 }
 
 func (r BuildRules) toKnit(w io.Writer) {
-	fmt.Fprintln(w, "return r{")
+	fmt.Fprintln(w, "return b{")
 	for _, c := range r {
 		c.toKnit(w)
 	}
@@ -363,31 +397,153 @@ func (c *BuildCommand) toMake(w io.Writer) {
 }
 
 func (c *BuildCommand) toKnit(w io.Writer) {
-	buf := &bytes.Buffer{}
-
-	buf.WriteString("$ ")
-
-	if len(c.Outputs) == 0 {
-		buf.WriteString(c.Name)
-	} else {
-		buf.WriteString(strings.Join(c.Outputs, " "))
+	targets := c.Outputs
+	var attrs AttrSet
+	if len(targets) == 0 {
+		targets = []string{c.Name}
+		attrs.Virtual = true
 	}
-	buf.WriteString(": ")
-	buf.WriteString(strings.Join(c.Prereqs, " "))
-	buf.WriteByte('\n')
 
 	cd := ""
 	if c.Directory != "." && c.Directory != "" {
 		cd = "cd " + c.Directory + "; "
 	}
+	commands := make([]string, 0, len(c.Commands))
 	for _, cmd := range c.Commands {
+		commands = append(commands, strings.ReplaceAll(cd+cmd, "$", "$$"))
+	}
+
+	// names that can't be written in the rule syntax use the Lua constructor
+	for _, name := range append(targets, c.Prereqs...) {
+		if !knitWritable(name) {
+			fmt.Fprintf(w, "%s,\n", luaRule(targets, nil, c.Prereqs, commands, nil, attrs))
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("$ ")
+	for i, t := range targets {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(knitQuote(t))
+	}
+	if attrs.Virtual {
+		buf.WriteString(":V")
+	}
+	buf.WriteString(":")
+	for _, p := range c.Prereqs {
+		buf.WriteByte(' ')
+		buf.WriteString(knitQuote(p))
+	}
+	buf.WriteByte('\n')
+
+	for _, cmd := range commands {
 		buf.WriteByte('\t')
-		buf.WriteString(cd + cmd)
+		buf.WriteString(cmd)
 		buf.WriteByte('\n')
 	}
 	w.Write(buf.Bytes())
 }
 
+// Returns true if 'name' can be written as a target or prereq in the rule
+// syntax. Names containing '%' would be treated as patterns.
+func knitWritable(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "%'\n")
+}
+
+// Quotes 'name' so that it is read literally as a target or prereq in the rule
+// syntax.
+func knitQuote(name string) string {
+	name = strings.ReplaceAll(name, "$", "$$")
+	if strings.ContainsAny(name, nonBareRunes) {
+		return "'" + name + "'"
+	}
+	return name
+}
+
+// Quotes 's' as a Lua string literal.
+func luaQuote(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(buf, "\\%03d", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func luaList(strs []string) string {
+	quoted := make([]string, 0, len(strs))
+	for _, s := range strs {
+		quoted = append(quoted, luaQuote(s))
+	}
+	return "{" + strings.Join(quoted, ", ") + "}"
+}
+
+// Returns a call to 'knit.rule' that constructs the given rule.
+func luaRule(targets, patterns, prereqs, recipe []string, vars map[string]string, attrs AttrSet) string {
+	fields := make([]string, 0, 5)
+	if len(targets) != 0 {
+		fields = append(fields, "targets="+luaList(targets))
+	}
+	if len(patterns) != 0 {
+		fields = append(fields, "patterns="+luaList(patterns))
+	}
+	if len(prereqs) != 0 {
+		fields = append(fields, "prereqs="+luaList(prereqs))
+	}
+	if len(recipe) != 0 {
+		fields = append(fields, "recipe="+luaList(recipe))
+	}
+	if len(vars) != 0 {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		vs := make([]string, 0, len(names))
+		for _, name := range names {
+			key := name
+			if strings.HasSuffix(name, "+") {
+				key = "[" + luaQuote(name) + "]"
+			}
+			vs = append(vs, fmt.Sprintf("%s=%s", key, luaQuote(vars[name])))
+		}
+		fields = append(fields, "vars={"+strings.Join(vs, ", ")+"}")
+	}
+	named := attrs.Named()
+	if len(named) != 0 {
+		names := make([]string, 0, len(named))
+		for name := range named {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		as := make([]string, 0, len(names))
+		for _, name := range names {
+			switch v := named[name].(type) {
+			case bool:
+				as = append(as, fmt.Sprintf("%s=%v", name, v))
+			case string:
+				as = append(as, fmt.Sprintf("%s=%s", name, luaQuote(v)))
+			}
+		}
+		fields = append(fields, "attrs={"+strings.Join(as, ", ")+"}")
+	}
+	return `require("knit").rule{` + strings.Join(fields, ", ") + "}"
+}
+
 func (c *BuildCommand) toNinja(w io.Writer) {
 	if len(c.Commands) > 0 {
 		fmt.Fprintf(w, "rule %s\n", strings.Replace(c.Name, "/", "_", -1))
@@ -427,6 +583,7 @@ func (t *CommandsTool) commands(n *node, visited map[*info]bool, cmds BuildRules
 		for _, o := range n.outputs {
 			outputs = append(outputs, filepath.Clean(o.name))
 		}
+		sort.Strings(outputs)
 
 		cmds = append(cmds, BuildCommand{
 			Directory: n.dir,
@@ -434,7 +591,7 @@ func (t *CommandsTool) commands(n *node, visited map[*info]bool, cmds BuildRules
 			Inputs:    inputs,
 			Outputs:   outputs,
 			Name:      filepath.Join(n.dir, n.myTarget),
-			Commands:  n.recipe,
+			Commands:  n.commands(),
 		})
 	}
 
@@ -459,7 +616,7 @@ func (t *CommandsTool) shell(n *node, visited map[*info]bool, w io.Writer) {
 	if n.dir != "." && n.dir != "" {
 		cd = "cd " + n.dir + ";"
 	}
-	for _, c := range n.recipe {
+	for _, c := range n.commands() {
 		var cmd string
 		if cd != "" {
 			cmd = fmt.Sprintf("(%s %s)\n", cd, c)
@@ -516,7 +673,7 @@ func (t *StatusTool) visit(prev UpdateReason, indent string, n *node, visited ma
 	if n.rule.attrs.Linked && status == UpToDate && prev != UpToDate {
 		status = LinkedUpdate
 	}
-	fmt.Fprintf(t.W, "%s%s: [%s]\n", indent, n2str(n), status)
+	fmt.Fprintf(t.W, "%s%s: [%s]\n", indent, n2str(n), n.reason(status))
 	if visited[n] && len(n.prereqs) > 0 {
 		fmt.Fprintf(t.W, "%s  ...\n", indent)
 		return
@@ -554,6 +711,102 @@ func (t *DbTool) String() string {
 	return "db - show database information"
 }
 
+type RecipeDiffTool struct {
+	W  io.Writer
+	Db *Database
+}
+
+func (t *RecipeDiffTool) diff(n *node, all bool) {
+	if len(n.rule.recipe) == 0 {
+		if !all {
+			fmt.Fprintf(t.W, "%s: no recipe\n", n2str(n))
+		}
+		return
+	}
+	diff, ok := n.recipeDiff(t.Db)
+	if !ok {
+		if !all {
+			fmt.Fprintf(t.W, "%s: no recipe recorded\n", n2str(n))
+		}
+		return
+	}
+	changed := false
+	for _, l := range diff {
+		if l[0] != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		if !all {
+			fmt.Fprintf(t.W, "%s: recipe unchanged\n", n2str(n))
+		}
+		return
+	}
+	fmt.Fprintf(t.W, "--- %s (recorded)\n", n2str(n))
+	fmt.Fprintf(t.W, "+++ %s (current)\n", n2str(n))
+	for _, l := range diff {
+		fmt.Fprintln(t.W, l)
+	}
+}
+
+func (t *RecipeDiffTool) visit(n *node, visited map[*info]bool) {
+	if visited[n.info] {
+		return
+	}
+	visited[n.info] = true
+	for _, p := range n.prereqs {
+		t.visit(p, visited)
+	}
+	t.diff(n, true)
+}
+
+func (t *RecipeDiffTool) Run(g *Graph, args []string) error {
+	if len(args) == 0 {
+		t.visit(g.base, make(map[*info]bool))
+		return nil
+	}
+	for _, a := range args {
+		n, ok := g.nodes[filepath.Clean(a)]
+		if !ok {
+			return fmt.Errorf("target '%s' is not in the build graph", a)
+		}
+		t.diff(n, false)
+	}
+	return nil
+}
+
+func (t *RecipeDiffTool) String() string {
+	return "recipe-diff - show how recipes changed since they were last run (pass targets, or nothing for all changed recipes)"
+}
+
+type ResolveTool struct {
+	W io.Writer
+}
+
+func (t *ResolveTool) Run(g *Graph, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("resolve: no target given")
+	}
+	for i, a := range args {
+		if i != 0 {
+			fmt.Fprintln(t.W)
+		}
+		// resolve the target in a fresh graph so that every decision is
+		// made (and traced) again
+		tg := newGraph(g.rules, g.updated)
+		tg.trace = &resolveTrace{w: t.W}
+		if _, err := tg.resolve(a); err != nil {
+			fmt.Fprintf(t.W, "error: %v\n", err)
+		}
+	}
+	return nil
+}
+
+func (t *ResolveTool) String() string {
+	return "resolve - explain which rule is chosen to build a target, and why other candidates were not"
+}
+
 type PathTool struct {
 	W    io.Writer
 	Path string
@@ -567,3 +820,36 @@ func (t *PathTool) Run(g *Graph, args []string) error {
 func (t *PathTool) String() string {
 	return "path - return the path of the current knitfile"
 }
+
+// An Option is a build option declared by the Knitfile.
+type Option struct {
+	Name    string
+	Type    string
+	Default string
+	Value   string
+	Source  string // where the value came from: cli, env, or default
+	Help    string
+}
+
+type OptionsTool struct {
+	W       io.Writer
+	Options []Option
+}
+
+func (t *OptionsTool) Run(g *Graph, args []string) error {
+	for _, o := range t.Options {
+		fmt.Fprintf(t.W, "%s (%s) = %s", o.Name, o.Type, o.Value)
+		if o.Source != "default" {
+			fmt.Fprintf(t.W, " [%s, default %s]", o.Source, o.Default)
+		}
+		fmt.Fprintln(t.W)
+		if o.Help != "" {
+			fmt.Fprintf(t.W, "    %s\n", o.Help)
+		}
+	}
+	return nil
+}
+
+func (t *OptionsTool) String() string {
+	return "options - list the build options with their values"
+}
@@ -0,0 +1,88 @@
+package rules
+
+// A NodeView is a read-only description of a node in the build graph.
+type NodeView struct {
+	Name      string                 // the target that this node builds
+	Targets   []string               // all targets of the node's rule
+	Prereqs   []string               // names of the prereq nodes
+	Recipe    []string               // the expanded recipe
+	Dir       string                 // directory the recipe runs in
+	Attrs     map[string]interface{} // attributes by long name (see AttrSet.Named)
+	OutOfDate bool
+	Status    string // reason the node is out-of-date, or "up-to-date"
+}
+
+// A GraphView is a read-only snapshot of a build graph. Modifying a view does
+// not affect the graph.
+type GraphView struct {
+	// all nodes of the graph, with prereqs before the nodes that depend on
+	// them
+	Nodes []*NodeView
+	names map[string]*NodeView
+}
+
+// View returns a snapshot of the graph. The database is used to determine the
+// status of each node.
+func (g *Graph) View(db *Database, hash bool) *GraphView {
+	v := &GraphView{
+		names: make(map[string]*NodeView),
+	}
+	v.visit(g.base, db, hash)
+	return v
+}
+
+func (v *GraphView) visit(n *node, db *Database, hash bool) {
+	name := n2str(n)
+	if _, ok := v.names[name]; ok {
+		return
+	}
+	nv := &NodeView{
+		Name:    name,
+		Targets: make([]string, 0, len(n.rule.targets)),
+		Prereqs: make([]string, 0, len(n.prereqs)),
+		Recipe:  append([]string(nil), n.recipe...),
+		Dir:     n.dir,
+		Attrs:   n.rule.attrs.Named(),
+	}
+	// mark before visiting prereqs in case of duplicate prereqs
+	v.names[name] = nv
+	for _, t := range n.rule.targets {
+		nv.Targets = append(nv.Targets, pathJoin(n.dir, t))
+	}
+	for _, p := range n.prereqs {
+		nv.Prereqs = append(nv.Prereqs, n2str(p))
+		v.visit(p, db, hash)
+	}
+	status := n.outOfDate(db, hash, false)
+	nv.OutOfDate = status != UpToDate
+	nv.Status = n.reason(status)
+	v.Nodes = append(v.Nodes, nv)
+}
+
+// Node returns the node that builds 'name', or nil if there is no such node.
+func (v *GraphView) Node(name string) *NodeView {
+	return v.names[name]
+}
+
+// Deps returns the names of all nodes that 'name' depends on, directly or
+// indirectly, with prereqs before the nodes that depend on them.
+func (v *GraphView) Deps(name string) []string {
+	deps := []string{}
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		n := v.names[name]
+		if n == nil {
+			return
+		}
+		for _, p := range n.Prereqs {
+			if !visited[p] {
+				visited[p] = true
+				visit(p)
+				deps = append(deps, p)
+			}
+		}
+	}
+	visit(name)
+	return deps
+}
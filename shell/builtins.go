@@ -0,0 +1,403 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"mvdan.cc/sh/interp"
+)
+
+// A builtin is a file command that is implemented without spawning a process.
+// Paths are relative to 'dir'.
+type builtin func(dir string, args []string, stdin io.Reader, stdout io.Writer) error
+
+// Returned by a builtin when it is invoked with an option that it does not
+// implement, in which case the real command is run instead.
+var errUnsupported = errors.New("unsupported option")
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"cp":    cp,
+		"mv":    mv,
+		"rm":    rm,
+		"mkdir": mkdir,
+		"touch": touch,
+		"cat":   cat,
+		"ln":    ln,
+		"stamp": stamp,
+	}
+}
+
+// IsBuiltin returns true if 'name' is a command that is implemented internally.
+func IsBuiltin(name string) bool {
+	_, ok := builtins[name]
+	return ok
+}
+
+// Executes builtins internally, and all other commands as processes.
+func execBuiltins(ctx context.Context, path string, args []string) error {
+	b, ok := builtins[args[0]]
+	if !ok {
+		return interp.DefaultExec(ctx, path, args)
+	}
+	mc, _ := interp.FromModuleContext(ctx)
+	err := b(mc.Dir, args[1:], mc.Stdin, mc.Stdout)
+	if errors.Is(err, errUnsupported) && path != "" {
+		return interp.DefaultExec(ctx, path, args)
+	} else if err != nil {
+		fmt.Fprintf(mc.Stderr, "%s: %v\n", args[0], err)
+		return interp.ExitStatus(1)
+	}
+	return nil
+}
+
+// Separates the flags from the operands in 'args'. Each flag must be one of
+// the runes in 'allowed', otherwise errUnsupported is returned.
+func parseFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	flags := make(map[rune]bool)
+	for i, a := range args {
+		if a == "--" {
+			return flags, args[i+1:], nil
+		}
+		if len(a) < 2 || a[0] != '-' {
+			return flags, args[i:], nil
+		}
+		for _, r := range a[1:] {
+			if !strings.ContainsRune(allowed, r) {
+				return nil, nil, fmt.Errorf("%w -%c", errUnsupported, r)
+			}
+			flags[r] = true
+		}
+	}
+	return flags, nil, nil
+}
+
+func abs(dir, path string) string {
+	if filepath.IsAbs(path) || dir == "" {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Returns the destination for each source when the last operand is the
+// target. If there are multiple sources, the target must be a directory.
+func targets(dir string, operands []string) ([][2]string, error) {
+	if len(operands) < 2 {
+		return nil, errors.New("missing destination operand")
+	}
+	srcs, dst := operands[:len(operands)-1], abs(dir, operands[len(operands)-1])
+	todir := isDir(dst)
+	if len(srcs) > 1 && !todir {
+		return nil, fmt.Errorf("target '%s' is not a directory", operands[len(operands)-1])
+	}
+	pairs := make([][2]string, 0, len(srcs))
+	for _, s := range srcs {
+		d := dst
+		if todir {
+			d = filepath.Join(dst, filepath.Base(s))
+		}
+		pairs = append(pairs, [2]string{abs(dir, s), d})
+	}
+	return pairs, nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Returns 'path' relative to 'dir', to name it in an error.
+func display(dir, path string) string {
+	if dir == "" {
+		return path
+	}
+	if r, err := filepath.Rel(dir, path); err == nil {
+		return r
+	}
+	return path
+}
+
+// Returns an error if copying 'src' to 'dst' would overwrite the source,
+// because they are the same file or 'dst' is inside the directory 'src'.
+func checkCopy(dir, src, dst string) error {
+	sinfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if dinfo, err := os.Stat(dst); err == nil && os.SameFile(sinfo, dinfo) {
+		return fmt.Errorf("'%s' and '%s' are the same file", display(dir, src), display(dir, dst))
+	}
+	if !sinfo.IsDir() {
+		return nil
+	}
+	asrc, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	adst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if r, err := filepath.Rel(asrc, adst); err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("cannot copy a directory, '%s', into itself, '%s'", display(dir, src), display(dir, dst))
+	}
+	return nil
+}
+
+func copyPath(src, dst string, recursive bool) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(src, dst, info.Mode())
+	}
+	if !recursive {
+		return fmt.Errorf("-r not specified; omitting directory '%s'", src)
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+// cp [-rRf] SRC... DST
+func cp(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, operands, err := parseFlags(args, "rRf")
+	if err != nil {
+		return err
+	}
+	pairs, err := targets(dir, operands)
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := checkCopy(dir, p[0], p[1]); err != nil {
+			return err
+		}
+		if err := copyPath(p[0], p[1], flags['r'] || flags['R']); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mv [-f] SRC... DST
+func mv(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	_, operands, err := parseFlags(args, "f")
+	if err != nil {
+		return err
+	}
+	pairs, err := targets(dir, operands)
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if err := os.Rename(p[0], p[1]); err != nil {
+			// renaming across filesystems is not possible, so copy instead
+			if !errors.Is(err, syscall.EXDEV) {
+				return err
+			}
+			if err := checkCopy(dir, p[0], p[1]); err != nil {
+				return err
+			}
+			if err := copyPath(p[0], p[1], true); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(p[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rm [-rRf] FILE...
+func rm(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, operands, err := parseFlags(args, "rRf")
+	if err != nil {
+		return err
+	}
+	for _, o := range operands {
+		path := abs(dir, o)
+		if flags['r'] || flags['R'] {
+			if !flags['f'] {
+				if _, err := os.Lstat(path); err != nil {
+					return err
+				}
+			}
+			err = os.RemoveAll(path)
+		} else if info, lerr := os.Lstat(path); lerr == nil && info.IsDir() {
+			// a symlink to a directory is removed like a file
+			err = fmt.Errorf("cannot remove '%s': is a directory", o)
+		} else {
+			err = os.Remove(path)
+			if flags['f'] && errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdir [-p] DIR...
+func mkdir(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, operands, err := parseFlags(args, "p")
+	if err != nil {
+		return err
+	}
+	for _, o := range operands {
+		if flags['p'] {
+			err = os.MkdirAll(abs(dir, o), os.ModePerm)
+		} else {
+			err = os.Mkdir(abs(dir, o), os.ModePerm)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch [-c] FILE...
+func touch(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, operands, err := parseFlags(args, "c")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, o := range operands {
+		path := abs(dir, o)
+		err := os.Chtimes(path, now, now)
+		if errors.Is(err, os.ErrNotExist) {
+			if flags['c'] {
+				continue
+			}
+			var f *os.File
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+			if err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cat [FILE...]
+func cat(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	_, operands, err := parseFlags(args, "")
+	if err != nil {
+		return err
+	}
+	if len(operands) == 0 {
+		operands = []string{"-"}
+	}
+	for _, o := range operands {
+		if o == "-" {
+			if stdin != nil {
+				if _, err := io.Copy(stdout, stdin); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		f, err := os.Open(abs(dir, o))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stdout, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ln [-sf] TARGET... LINK
+func ln(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, operands, err := parseFlags(args, "sf")
+	if err != nil {
+		return err
+	}
+	pairs, err := targets(dir, operands)
+	if err != nil {
+		return err
+	}
+	for i, p := range pairs {
+		if flags['f'] {
+			os.Remove(p[1])
+		}
+		if flags['s'] {
+			// symbolic links are relative to the link, so use the target as
+			// it was written
+			err = os.Symlink(operands[i], p[1])
+		} else {
+			err = os.Link(p[0], p[1])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stamp FILE...
+//
+// Writes the current time to each file, so that both its timestamp and its
+// contents change.
+func stamp(dir string, args []string, stdin io.Reader, stdout io.Writer) error {
+	_, operands, err := parseFlags(args, "")
+	if err != nil {
+		return err
+	}
+	now := []byte(time.Now().Format(time.RFC3339Nano) + "\n")
+	for _, o := range operands {
+		if err := os.WriteFile(abs(dir, o), now, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
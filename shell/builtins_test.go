@@ -0,0 +1,113 @@
+package shell
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunBuiltin(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	run := func(cmd string) {
+		ok, err := RunBuiltin(cmd, dir, nil, &stdout, &stderr)
+		if !ok || err != nil {
+			t.Fatalf("%s: ok=%v err=%v stderr=%q", cmd, ok, err, stderr.String())
+		}
+	}
+
+	run("mkdir -p a/b")
+	run("touch a/b/x")
+	run("stamp a/y")
+	run("cp -r a c")
+	run("mv c/y c/z")
+	run("ln -s z c/w")
+	run("cat a/b/x c/w")
+	data, err := os.ReadFile(filepath.Join(dir, "a/y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != string(data) {
+		t.Fatalf("cat: got %q, want %q", stdout.String(), data)
+	}
+	run("rm -rf a c/b")
+	for _, f := range []string{"a", "c/b", "c/y"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Fatalf("'%s' exists", f)
+		}
+	}
+
+	if ok, err := RunBuiltin("rm missing", dir, nil, &stdout, &stderr); !ok || err == nil {
+		t.Fatalf("rm of missing file: ok=%v err=%v", ok, err)
+	}
+	for _, cmd := range []string{"echo hi", "cp a b > c", "rm *.o", "cp -i a b", "x=1 rm a", "rm a; rm b"} {
+		if ok, _ := RunBuiltin(cmd, dir, nil, &stdout, &stderr); ok {
+			t.Fatalf("%s: should not run as a builtin", cmd)
+		}
+	}
+}
+
+func TestRunBuiltinErrors(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	run := func(cmd string) {
+		ok, err := RunBuiltin(cmd, dir, nil, &stdout, &stderr)
+		if !ok || err != nil {
+			t.Fatalf("%s: ok=%v err=%v stderr=%q", cmd, ok, err, stderr.String())
+		}
+	}
+	fail := func(cmd, msg string) {
+		stderr.Reset()
+		ok, err := RunBuiltin(cmd, dir, nil, &stdout, &stderr)
+		if !ok || err == nil {
+			t.Fatalf("%s: should fail: ok=%v err=%v", cmd, ok, err)
+		}
+		if got := strings.TrimSpace(stderr.String()); got != msg {
+			t.Fatalf("%s: got %q, want %q", cmd, got, msg)
+		}
+	}
+	data := func(file string) string {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("data"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	fail("cp a .", "cp: 'a' and 'a' are the same file")
+	fail("cp a a", "cp: 'a' and 'a' are the same file")
+	if data("a") != "data" {
+		t.Fatalf("cp to the same file truncated the source")
+	}
+
+	run("mkdir -p s/d")
+	run("cp a s/d/f")
+	fail("cp -r s s/d/t", "cp: cannot copy a directory, 's', into itself, 's/d/t'")
+	if _, err := os.Stat(filepath.Join(dir, "s/d/t")); err == nil {
+		t.Fatalf("cp copied a directory into itself")
+	}
+
+	// moving onto a directory that is not empty fails instead of merging
+	run("mkdir -p t/s/old")
+	if ok, err := RunBuiltin("mv s t", dir, nil, &stdout, &stderr); !ok || err == nil {
+		t.Fatalf("mv onto a non-empty directory: ok=%v err=%v", ok, err)
+	}
+	if data("s/d/f") != "data" {
+		t.Fatalf("mv removed the source")
+	}
+
+	// a symlink to a directory is removed, not the directory
+	run("ln -s s link")
+	run("rm link")
+	if _, err := os.Lstat(filepath.Join(dir, "link")); err == nil {
+		t.Fatalf("'link' exists")
+	}
+	if data("s/d/f") != "data" {
+		t.Fatalf("rm removed the target of the link")
+	}
+}
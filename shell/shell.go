@@ -2,24 +2,182 @@ package shell
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"mvdan.cc/sh/expand"
 	"mvdan.cc/sh/interp"
 	"mvdan.cc/sh/syntax"
 )
 
+// Run executes 'cmd' with the internal shell. File commands such as cp, mv, and
+// rm are run as builtins (see IsBuiltin) rather than as processes.
 func Run(cmd string) error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	r, err := NewRunner()
 	if err != nil {
 		return err
 	}
+	return r.Run(cmd, "", nil, os.Stdin, os.Stdout, os.Stderr)
+}
 
-	prog, err := syntax.NewParser().Parse(strings.NewReader(cmd), "")
+// A Runner executes commands with the internal shell within this process. A
+// Runner may be reused for many commands, but not concurrently.
+type Runner struct {
+	interp *interp.Runner
+	parser *syntax.Parser
+}
+
+func NewRunner() (*Runner, error) {
+	r, err := interp.New(interp.Module(interp.ModuleExec(execBuiltins)))
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{
+		interp: r,
+		parser: syntax.NewParser(),
+	}, nil
+}
+
+// Run executes 'cmd' in the directory 'dir' with the environment 'env'. If
+// 'dir' is empty the current directory is used, and if 'env' is nil the
+// environment of this process is used. The 'stdin' reader may be nil.
+func (r *Runner) Run(cmd, dir string, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	prog, err := r.parser.Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		return err
+	}
+	if err := r.reset(dir, env, stdin, stdout, stderr); err != nil {
+		return err
+	}
+	return r.interp.Run(context.Background(), prog)
+}
+
+// RunScript executes the top-level statements of 'script' one at a time, like
+// Run, and stops at the first one that fails. Before each statement that
+// starts a new line, 'step' is called with that line (see StmtLines).
+func (r *Runner) RunScript(script, dir string, env []string, stdin io.Reader, stdout, stderr io.Writer, step func(line int)) error {
+	prog, err := r.parser.Parse(strings.NewReader(script), "")
+	if err != nil {
+		return err
+	}
+	if err := r.reset(dir, env, stdin, stdout, stderr); err != nil {
+		return err
+	}
+	prev := 0
+	for _, stmt := range prog.Stmts {
+		if l := int(stmt.Pos().Line()); l != prev {
+			step(l)
+			prev = l
+		}
+		err := r.interp.Run(context.Background(), stmt)
+		var exit interp.ShellExitStatus
+		if errors.As(err, &exit) && exit == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prepares the interpreter to run commands in 'dir' with 'env'.
+func (r *Runner) reset(dir string, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var err error
+	if dir == "" {
+		dir, err = os.Getwd()
+	} else {
+		dir, err = filepath.Abs(dir)
+	}
 	if err != nil {
 		return err
 	}
-	r.Reset()
-	ctx := context.Background()
-	return r.Run(ctx, prog)
+	if env == nil {
+		env = os.Environ()
+	}
+	r.interp.Dir = dir
+	r.interp.Env = expand.ListEnviron(env...)
+	r.interp.Stdin = stdin
+	r.interp.Stdout = stdout
+	r.interp.Stderr = stderr
+	r.interp.Reset()
+	return nil
+}
+
+// StmtLines returns the lines (starting at 1) that the top-level statements of
+// 'script' start on. Statements that start on the same line are counted once,
+// and a statement continues until the line on which the next one starts, so
+// multi-line constructs such as here-documents are never split.
+func StmtLines(script string) ([]int, error) {
+	prog, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		return nil, err
+	}
+	var lines []int
+	for _, stmt := range prog.Stmts {
+		if l := int(stmt.Pos().Line()); len(lines) == 0 || lines[len(lines)-1] != l {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// RunBuiltin executes 'cmd' in the directory 'dir' without starting a shell if
+// it is a single invocation of a builtin with literal arguments. It returns
+// false if 'cmd' must be run by a shell instead. The 'stdin' reader may be nil.
+func RunBuiltin(cmd, dir string, stdin io.Reader, stdout, stderr io.Writer) (bool, error) {
+	prog, err := syntax.NewParser().Parse(strings.NewReader(cmd), "")
+	if err != nil || len(prog.Stmts) != 1 {
+		return false, nil
+	}
+	stmt := prog.Stmts[0]
+	if stmt.Negated || stmt.Background || len(stmt.Redirs) != 0 {
+		return false, nil
+	}
+	call, ok := stmt.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Assigns) != 0 || len(call.Args) == 0 {
+		return false, nil
+	}
+	args := make([]string, 0, len(call.Args))
+	for _, w := range call.Args {
+		lit := w.Lit()
+		if lit == "" || strings.ContainsAny(lit, "*?[~") {
+			return false, nil
+		}
+		args = append(args, lit)
+	}
+	b, ok := builtins[args[0]]
+	if !ok {
+		return false, nil
+	}
+	err = b(dir, args[1:], stdin, stdout)
+	if errors.Is(err, errUnsupported) {
+		return false, nil
+	} else if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", args[0], err)
+		return true, fmt.Errorf("exit status 1")
+	}
+	return true, nil
+}
+
+// Commands returns the names of the commands invoked by 'cmd'. Only commands
+// whose names are literal words are returned.
+func Commands(cmd string) ([]string, error) {
+	prog, err := syntax.NewParser().Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	syntax.Walk(prog, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok && len(call.Args) > 0 {
+			if name := call.Args[0].Lit(); name != "" {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	return names, nil
 }
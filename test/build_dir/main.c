@@ -0,0 +1,2 @@
+#include "lib/util.h"
+int main() { return util(); }
@@ -0,0 +1,8 @@
+/* generated by knit */
+#define HAVE_STDIO_H 1
+/* #undef HAVE_KNIT_NO_SUCH_HEADER_H */
+#define HAVE_PRINTF 1
+/* #undef HAVE_KNIT_NO_SUCH_FUNCTION */
+#define HAVE_WALL 1
+/* #undef HAVE_BROKEN_SYNTAX */
+#define VERSION "1.0"
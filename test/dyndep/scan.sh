@@ -0,0 +1,14 @@
+# Writes a dyndep file for the sources given as arguments. A source that
+# provides module m also outputs m.mod, and a source that uses m depends on
+# m.mod.
+for f in "$@"; do
+    printf '%s' "${f%.src}.o"
+    for m in $(sed -n 's/^provides //p' "$f"); do
+        printf ' %s.mod' "$m"
+    done
+    printf ':'
+    for m in $(sed -n 's/^uses //p' "$f"); do
+        printf ' %s.mod' "$m"
+    done
+    echo
+done
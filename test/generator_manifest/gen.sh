@@ -0,0 +1,9 @@
+# Generates a source and header for each name in the file $1, in the directory
+# $2, and lists them in $2/files.txt.
+rm -f "$2"/*.c "$2"/*.h "$2/files.txt"
+mkdir -p "$2"
+for name in $(cat "$1"); do
+    echo "int $name;" > "$2/$name.c"
+    echo "extern int $name;" > "$2/$name.h"
+    printf '%s/%s.c\n%s/%s.h\n' "$2" "$name" "$2" "$name" >> "$2/files.txt"
+done
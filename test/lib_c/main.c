@@ -0,0 +1,5 @@
+#include "util.h"
+
+int main(void) {
+    return add(1, 2) == 3 ? 0 : 1;
+}
@@ -10,15 +10,18 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/gobwas/glob"
 	"github.com/kballard/go-shellquote"
+	"github.com/segmentio/fasthash/fnv1a"
 	"github.com/zyedidia/generic/stack"
 	lua "github.com/zyedidia/gopher-lua"
 	luar "github.com/zyedidia/gopher-luar"
 	"github.com/zyedidia/knit/expand"
+	"github.com/zyedidia/knit/rules"
 )
 
 // A LuaVM tracks the Lua state and keeps a stack of directories that have been
@@ -26,18 +29,60 @@ import (
 type LuaVM struct {
 	L     *lua.LState
 	wd    *stack.Stack[string]
-	shell string // shell used to execute commands
-	flags Flags  // flags are accessible to Lua programs
+	shell string      // shell used to execute commands
+	flags Flags       // flags are accessible to Lua programs
+	pkg   *lua.LTable // the 'knit' package
+
+	// environment that recipes are run with, computed on first use
+	recipeEnv map[string]string
+	// tools declared with 'knit.tool', mapped to their version commands
+	tools map[string]string
+	// fingerprints of declared tools, computed on first use
+	fingerprints map[string]string
+	// functions registered with 'knit.ongraph'
+	graphHooks []*lua.LFunction
+	// functions registered with 'knit.on', by event
+	hooks map[string][]*lua.LFunction
+	// options declared with 'knit.option'
+	options []rules.Option
+	// variants declared with 'knit.variant'
+	variants []variant
+	// results of checks, written by 'config_h' in 'knit.check'
+	defines []define
+	// database for caching check results, if available
+	db *rules.Database
+}
+
+// A variant is a configuration of the build declared with 'knit.variant'. The
+// Knitfile is evaluated again for each variant that is built, with the
+// variant's assignments added to the 'cli' table.
+type variant struct {
+	name string
+	vars []assign
 }
 
+// Build events that functions may be registered for with 'knit.on'.
+var hookEvents = []string{"start", "node", "finish"}
+
+// Environment variables that are passed to recipes in hermetic mode by
+// default.
+var defaultPassEnv = []string{"PATH", "HOME", "TMPDIR"}
+
 // An LRule is an un-parsed Lua representation of a build rule.
 type LRule struct {
 	Contents string
 	File     string
 	Line     int
+	// rule constructed with 'knit.rule', used instead of Contents
+	Spec *rules.RuleSpec
+	// variables that were expanded from Lua when the rule was created
+	expanded []string
 }
 
 func (r LRule) String() string {
+	if r.Spec != nil {
+		return r.Spec.String()
+	}
 	return "$ " + r.Contents
 }
 
@@ -56,8 +101,10 @@ func (rs LRuleSet) String() string {
 
 // An LBuildSet is a list of rules associated with a directory.
 type LBuildSet struct {
-	Dir  string
-	rset LRuleSet
+	Dir string
+	// directory that outputs are written to, relative to Dir
+	BuildDir string
+	rset     LRuleSet
 	// list of build sets, relative to the root buildset
 	bsets []LBuildSet
 }
@@ -94,6 +141,9 @@ func (bs *LBuildSet) String() string {
 	}
 	buf.WriteString("\n}, ")
 	buf.WriteString(strconv.Quote(bs.Dir))
+	if bs.BuildDir != "" {
+		buf.WriteString(", " + strconv.Quote(bs.BuildDir))
+	}
 	buf.WriteByte(')')
 	return buf.String()
 }
@@ -107,6 +157,10 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 		wd:    stack.New[string](),
 		shell: shell,
 		flags: flags,
+
+		tools:        make(map[string]string),
+		fingerprints: make(map[string]string),
+		hooks:        make(map[string][]*lua.LFunction),
 	}
 	vm.wd.Push(".")
 
@@ -117,12 +171,21 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 
 	// Rules
 	mkrule := func(rule string, file string, line int) LRule {
+		var expanded []string
+		lookup := func(name string) (string, error) {
+			s, err := rvar(name)
+			if err == nil {
+				expanded = append(expanded, name)
+			}
+			return s, err
+		}
 		// ignore errors during Lua-time rule expansion
-		s, _ := expand.Expand(rule, rvar, rexpr, false)
+		s, _ := expand.Expand(rule, lookup, rexpr, false)
 		return LRule{
 			Contents: s,
 			File:     file,
 			Line:     line,
+			expanded: expanded,
 		}
 	}
 	rmt := luar.MT(L, LRule{})
@@ -202,8 +265,12 @@ func NewLuaVM(shell string, flags Flags) *LuaVM {
 			vm.Err(fmt.Errorf("requires table, but got value %v", lv.Type()))
 		}
 		dir := L.OptString(2, ".")
+		if err := rules.CheckBuildDir(L.OptString(3, "")); err != nil {
+			vm.Err(err)
+		}
 		b := LBuildSet{
-			Dir: filepath.Join(vm.Wd(), dir),
+			Dir:      filepath.Join(vm.Wd(), dir),
+			BuildDir: L.OptString(3, ""),
 		}
 		b.Add(vals, vm)
 		L.Push(luar.New(L, b))
@@ -422,6 +489,128 @@ func (vm *LuaVM) DoFile(file string) (lua.LValue, error) {
 	}
 }
 
+// RunGraphHooks calls the functions registered with 'knit.ongraph' with a view
+// of the build graph, which is created by 'view' when a function first uses
+// it. Each function may return a buildset of rules to add to the build, and
+// all returned buildsets are returned.
+func (vm *LuaVM) RunGraphHooks(view func() *rules.GraphView) ([]LBuildSet, error) {
+	var added []LBuildSet
+	for _, fn := range vm.graphHooks {
+		err := vm.L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    1,
+			Protect: true,
+		}, vm.graphTable(view))
+		if err != nil {
+			return nil, err
+		}
+		ret := vm.L.Get(-1)
+		vm.L.Pop(1)
+		switch v := ret.(type) {
+		case *lua.LNilType:
+		case *lua.LUserData:
+			bs, ok := v.Value.(LBuildSet)
+			if !ok {
+				return nil, fmt.Errorf("graph hook returned invalid value: %v", ret)
+			}
+			added = append(added, bs)
+		default:
+			return nil, fmt.Errorf("graph hook returned invalid value: %v", ret)
+		}
+	}
+	return added, nil
+}
+
+// HasHooks returns true if functions are registered for 'event'.
+func (vm *LuaVM) HasHooks(event string) bool {
+	return len(vm.hooks[event]) != 0
+}
+
+// RunHooks calls the functions registered with 'knit.on' for 'event', in the
+// order they were registered. Each function is passed a table with the given
+// fields.
+func (vm *LuaVM) RunHooks(event string, fields map[string]lua.LValue) error {
+	for _, fn := range vm.hooks[event] {
+		tbl := vm.L.NewTable()
+		for k, v := range fields {
+			vm.L.SetField(tbl, k, v)
+		}
+		err := vm.L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    0,
+			Protect: true,
+		}, tbl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a Lua table with the fields of graphTableOf for the graph view
+// created by 'view'. The view is only created when a field is first read.
+func (vm *LuaVM) graphTable(view func() *rules.GraphView) *lua.LTable {
+	L := vm.L
+	tbl := L.NewTable()
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		fields := vm.graphTableOf(view())
+		fields.ForEach(func(k, v lua.LValue) {
+			tbl.RawSet(k, v)
+		})
+		L.SetMetatable(tbl, lua.LNil)
+		L.Push(tbl.RawGet(L.Get(2)))
+		return 1
+	}))
+	L.SetMetatable(tbl, mt)
+	return tbl
+}
+
+// Converts a graph view to a Lua table with the fields 'nodes', an array of all
+// nodes with prereqs first, and the functions 'node(name)' and 'deps(name)'.
+func (vm *LuaVM) graphTableOf(g *rules.GraphView) *lua.LTable {
+	L := vm.L
+	nodes := make(map[string]*lua.LTable, len(g.Nodes))
+	arr := L.NewTable()
+	for _, n := range g.Nodes {
+		attrs := L.NewTable()
+		for k, v := range n.Attrs {
+			switch v := v.(type) {
+			case bool:
+				L.SetField(attrs, k, lua.LBool(v))
+			case string:
+				L.SetField(attrs, k, lua.LString(v))
+			}
+		}
+		tbl := L.NewTable()
+		L.SetField(tbl, "name", lua.LString(n.Name))
+		L.SetField(tbl, "targets", GoStrSliceToTable(L, n.Targets))
+		L.SetField(tbl, "prereqs", GoStrSliceToTable(L, n.Prereqs))
+		L.SetField(tbl, "recipe", GoStrSliceToTable(L, n.Recipe))
+		L.SetField(tbl, "dir", lua.LString(n.Dir))
+		L.SetField(tbl, "attrs", attrs)
+		L.SetField(tbl, "outofdate", lua.LBool(n.OutOfDate))
+		L.SetField(tbl, "status", lua.LString(n.Status))
+		nodes[n.Name] = tbl
+		arr.Append(tbl)
+	}
+	tbl := L.NewTable()
+	L.SetField(tbl, "nodes", arr)
+	L.SetField(tbl, "node", L.NewFunction(func(L *lua.LState) int {
+		if n, ok := nodes[L.CheckString(1)]; ok {
+			L.Push(n)
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	}))
+	L.SetField(tbl, "deps", L.NewFunction(func(L *lua.LState) int {
+		L.Push(GoStrSliceToTable(L, g.Deps(L.CheckString(1))))
+		return 1
+	}))
+	return tbl
+}
+
 // ExpandFuncs returns a set of functions used for expansion. The first expands
 // by looking up variables in the current Lua context, and the second evaluates
 // arbitrary Lua expressions.
@@ -469,14 +658,21 @@ func (vm *LuaVM) OpenDefaults() {
 	}
 }
 
-// OpenKnit makes the 'knit' library available as a preloaded module.
+// OpenKnit makes the 'knit' library available as a preloaded module, along
+// with the built-in 'knit.*' modules.
 func (vm *LuaVM) OpenKnit() {
 	pkg := vm.pkgknit()
+	vm.pkg = pkg
 	loader := func(L *lua.LState) int {
 		L.Push(pkg)
 		return 1
 	}
 	vm.L.PreloadModule("knit", loader)
+	vm.L.PreloadModule("knit.check", func(L *lua.LState) int {
+		L.Push(vm.pkgcheck())
+		return 1
+	})
+	vm.openLib()
 }
 
 // Returns a table containing all values exposed as part of the 'knit' library.
@@ -487,6 +683,8 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 	vm.L.SetField(pkg, "os", luar.New(vm.L, runtime.GOOS))
 	vm.L.SetField(pkg, "arch", luar.New(vm.L, runtime.GOARCH))
 	vm.L.SetField(pkg, "flags", luar.New(vm.L, vm.flags))
+	vm.L.SetField(pkg, "env", vm.L.NewTable())
+	vm.L.SetField(pkg, "passenv", GoStrSliceToTable(vm.L, defaultPassEnv))
 	vm.L.SetField(pkg, "join", luar.New(vm.L, func(strs ...[]string) *lua.LTable {
 		if len(strs) == 0 {
 			return nil
@@ -593,6 +791,63 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 		}
 		return string(bytes.TrimSpace(b))
 	}))
+	vm.L.SetField(pkg, "rule", luar.New(vm.L, func(tbl *lua.LTable) LRule {
+		dbg, ok := vm.L.GetStack(1)
+		file := "<rule>"
+		line := 0
+		if ok {
+			vm.L.GetInfo("nSl", dbg, nil)
+			file = dbg.Source
+			line = dbg.CurrentLine
+		}
+		spec, err := ruleSpec(tbl)
+		if err != nil {
+			vm.Err(err)
+		}
+		spec.File = file
+		spec.Line = line
+		return LRule{
+			File: file,
+			Line: line,
+			Spec: &spec,
+		}
+	}))
+	vm.L.SetField(pkg, "tool", luar.New(vm.L, func(name string, version ...string) {
+		vm.tools[name] = strings.Join(version, " ")
+	}))
+	vm.L.SetField(pkg, "ongraph", luar.New(vm.L, func(fn *lua.LFunction) {
+		vm.graphHooks = append(vm.graphHooks, fn)
+	}))
+	vm.L.SetField(pkg, "option", vm.L.NewFunction(func(L *lua.LState) int {
+		val, err := vm.option(L.CheckTable(1))
+		if err != nil {
+			vm.Err(err)
+		}
+		L.Push(val)
+		return 1
+	}))
+	vm.L.SetField(pkg, "variant", vm.L.NewFunction(func(L *lua.LState) int {
+		v, err := luaVariant(L.CheckTable(1))
+		if err != nil {
+			vm.Err(err)
+		}
+		for _, other := range vm.variants {
+			if other.name == v.name {
+				vm.ErrStr(fmt.Sprintf("variant: '%s' is already declared", v.name))
+			}
+		}
+		vm.variants = append(vm.variants, v)
+		return 0
+	}))
+	vm.L.SetField(pkg, "on", luar.New(vm.L, func(event string, fn *lua.LFunction) {
+		for _, e := range hookEvents {
+			if e == event {
+				vm.hooks[event] = append(vm.hooks[event], fn)
+				return
+			}
+		}
+		vm.ErrStr(fmt.Sprintf("on: unknown event '%s' (must be one of: %s)", event, strings.Join(hookEvents, ", ")))
+	}))
 	vm.L.SetField(pkg, "addpath", luar.New(vm.L, func(path string) {
 		if !filepath.IsAbs(path) {
 			wd, err := os.Getwd()
@@ -623,6 +878,278 @@ func (vm *LuaVM) pkgknit() *lua.LTable {
 	return pkg
 }
 
+// Converts a table passed to 'knit.rule' into a rule specification.
+func ruleSpec(tbl *lua.LTable) (rules.RuleSpec, error) {
+	var spec rules.RuleSpec
+	var err error
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch LToString(k) {
+		case "targets":
+			spec.Targets, err = luaStrings(v)
+		case "patterns":
+			spec.Patterns, err = luaStrings(v)
+		case "prereqs":
+			spec.Prereqs, err = luaStrings(v)
+		case "recipe":
+			if fn, ok := v.(*lua.LFunction); ok {
+				spec.Func, err = newLuaRecipe(fn)
+			} else if str, ok := v.(lua.LString); ok {
+				// a string recipe has one command per line
+				for _, c := range strings.Split(string(str), "\n") {
+					if strings.TrimSpace(c) != "" {
+						spec.Recipe = append(spec.Recipe, strings.TrimSpace(c))
+					}
+				}
+			} else {
+				spec.Recipe, err = luaStrings(v)
+			}
+		case "attrs":
+			spec.Attrs, err = luaAttrs(v)
+		case "vars":
+			spec.Vars, err = luaVars(v)
+		default:
+			err = fmt.Errorf("rule: unknown field '%s'", LToString(k))
+		}
+	})
+	return spec, err
+}
+
+// Converts a table passed to 'knit.variant' into a variant.
+func luaVariant(tbl *lua.LTable) (variant, error) {
+	var v variant
+	var err error
+	tbl.ForEach(func(k, val lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch LToString(k) {
+		case "name":
+			v.name = LToString(val)
+		case "vars":
+			vars, ok := val.(*lua.LTable)
+			if !ok {
+				err = fmt.Errorf("variant: vars must be a table, but got %v", val.Type())
+				return
+			}
+			vars.ForEach(func(name, value lua.LValue) {
+				v.vars = append(v.vars, assign{
+					name:  LToString(name),
+					value: LToString(value),
+				})
+			})
+		default:
+			err = fmt.Errorf("variant: unknown field '%s'", LToString(k))
+		}
+	})
+	if err == nil && v.name == "" {
+		err = fmt.Errorf("variant: a name is required")
+	}
+	sort.Slice(v.vars, func(i, j int) bool {
+		return v.vars[i].name < v.vars[j].name
+	})
+	return v, err
+}
+
+// Declares the option described by a table passed to 'knit.option', and returns
+// its value. The value is taken from the 'cli' table, then the 'env' table, and
+// otherwise is the default.
+func (vm *LuaVM) option(tbl *lua.LTable) (lua.LValue, error) {
+	var opt rules.Option
+	var def lua.LValue = lua.LNil
+	var choices []string
+	var err error
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch LToString(k) {
+		case "name":
+			opt.Name = LToString(v)
+		case "type":
+			opt.Type = LToString(v)
+		case "default":
+			def = v
+		case "help":
+			opt.Help = LToString(v)
+		case "choices":
+			choices, err = luaStrings(v)
+		default:
+			err = fmt.Errorf("option: unknown field '%s'", LToString(k))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opt.Name == "" {
+		return nil, fmt.Errorf("option: name is required")
+	}
+	if opt.Type == "" {
+		opt.Type = "string"
+	}
+
+	// the default must have the option's type
+	if def == lua.LNil {
+		switch opt.Type {
+		case "bool":
+			def = lua.LFalse
+		case "number":
+			def = lua.LNumber(0)
+		case "string":
+			def = lua.LString("")
+		}
+	} else if def, err = optionValue(opt.Type, LToString(def)); err != nil {
+		return nil, fmt.Errorf("option '%s': invalid default: %w", opt.Name, err)
+	}
+	if def == lua.LNil {
+		return nil, fmt.Errorf("option '%s': unknown type '%s' (must be one of: bool, number, string)", opt.Name, opt.Type)
+	}
+	opt.Default = LToString(def)
+
+	val := def
+	opt.Source = "default"
+	for _, src := range []string{"cli", "env"} {
+		tbl, ok := vm.L.GetGlobal(src).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		if s := vm.L.GetField(tbl, opt.Name); s != lua.LNil {
+			val, err = optionValue(opt.Type, LToString(s))
+			if err != nil {
+				return nil, fmt.Errorf("option '%s' (from %s): %w", opt.Name, src, err)
+			}
+			opt.Source = src
+			break
+		}
+	}
+	opt.Value = LToString(val)
+
+	if len(choices) != 0 {
+		valid := false
+		for _, c := range choices {
+			valid = valid || c == opt.Value
+		}
+		if !valid {
+			return nil, fmt.Errorf("option '%s': invalid value '%s' (must be one of: %s)", opt.Name, opt.Value, strings.Join(choices, ", "))
+		}
+		opt.Type += " " + strings.Join(choices, "|")
+	}
+
+	for _, o := range vm.options {
+		if o.Name == opt.Name {
+			if o.Type != opt.Type || o.Default != opt.Default {
+				return nil, fmt.Errorf("option '%s': declared again with a different type or default", opt.Name)
+			}
+			return val, nil
+		}
+	}
+	vm.options = append(vm.options, opt)
+	return val, nil
+}
+
+// Parses the string 's' as a value of an option with type 'typ'. Returns nil
+// if the type is unknown.
+func optionValue(typ, s string) (lua.LValue, error) {
+	switch typ {
+	case "bool":
+		switch strings.ToLower(s) {
+		case "true", "yes", "on", "1":
+			return lua.LTrue, nil
+		case "false", "no", "off", "0", "":
+			return lua.LFalse, nil
+		}
+		return nil, fmt.Errorf("'%s' is not a bool", s)
+	case "number":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", s)
+		}
+		return lua.LNumber(n), nil
+	case "string":
+		return lua.LString(s), nil
+	}
+	return lua.LNil, nil
+}
+
+// Options returns the options declared with 'knit.option'.
+func (vm *LuaVM) Options() []rules.Option {
+	return vm.options
+}
+
+// Converts a table of named attributes into an attribute set. Flags are set
+// with booleans, and other attributes take strings (or lists of strings).
+func luaAttrs(lv lua.LValue) (rules.AttrSet, error) {
+	var attrs rules.AttrSet
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return attrs, fmt.Errorf("rule: attrs must be a table, but got %v", lv.Type())
+	}
+	var err error
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		name := LToString(k)
+		if b, ok := v.(lua.LBool); ok {
+			err = attrs.SetFlag(name, bool(b))
+			return
+		}
+		var vals []string
+		vals, err = luaStrings(v)
+		if err == nil {
+			err = attrs.SetArg(name, strings.Join(vals, ","))
+		}
+	})
+	return attrs, err
+}
+
+// Converts a table of variables bound by a rule into a map. A value may be a
+// string or a list of strings, which are joined with spaces.
+func luaVars(lv lua.LValue) (map[string]string, error) {
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("rule: vars must be a table, but got %v", lv.Type())
+	}
+	vars := make(map[string]string)
+	var err error
+	tbl.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+		var vals []string
+		vals, err = luaStrings(v)
+		vars[LToString(k)] = strings.Join(vals, " ")
+	})
+	return vars, err
+}
+
+// Converts a string or a list of strings into a slice.
+func luaStrings(lv lua.LValue) ([]string, error) {
+	switch v := lv.(type) {
+	case lua.LString:
+		return []string{string(v)}, nil
+	case *lua.LTable:
+		strs := make([]string, 0, v.Len())
+		var err error
+		v.ForEach(func(_, e lua.LValue) {
+			switch e := e.(type) {
+			case lua.LString, lua.LNumber:
+				strs = append(strs, LToString(e))
+			default:
+				err = fmt.Errorf("rule: expected string but got %v", e.Type())
+			}
+		})
+		return strs, err
+	case *lua.LUserData:
+		if strs, ok := v.Value.([]string); ok {
+			return strs, nil
+		}
+	}
+	return nil, fmt.Errorf("rule: expected string or list of strings but got %v", lv.Type())
+}
+
 func replace(in []string, patstr, repl string) ([]string, error) {
 	rgx, err := regexp.Compile(patstr)
 	if err != nil {
@@ -681,6 +1208,165 @@ func (vm *LuaVM) SetVar(name string, val interface{}) {
 	}
 }
 
+// SetVars sets each variable in 'vars' to its string value, and returns a
+// function that restores the previous values.
+func (vm *LuaVM) SetVars(vars map[string]string) func() {
+	globals := vm.L.GetGlobal("_G").(*lua.LTable)
+	old := make(map[string]lua.LValue, len(vars))
+	for name, val := range vars {
+		old[name] = globals.RawGetString(name)
+		globals.RawSetString(name, lua.LString(val))
+	}
+	return func() {
+		for name, val := range old {
+			globals.RawSetString(name, val)
+		}
+	}
+}
+
+// Returns the environment that recipes are run with. It is computed once, when
+// it is first needed after the Knitfile has been evaluated.
+func (vm *LuaVM) environ() map[string]string {
+	if vm.recipeEnv == nil {
+		vm.recipeEnv = vm.currentEnviron()
+	}
+	return vm.recipeEnv
+}
+
+// Returns the recipe environment for the current values of 'knit.passenv' and
+// 'knit.env', without storing it, so that it may be used while the Knitfile is
+// still being evaluated. In hermetic mode only the variables listed in
+// 'knit.passenv' are inherited from this process. In both modes variables are
+// then overridden by 'knit.env', where a value of 'false' removes the variable.
+func (vm *LuaVM) currentEnviron() map[string]string {
+	env := make(map[string]string)
+	if vm.flags.Hermetic {
+		if pass, ok := vm.L.GetField(vm.pkg, "passenv").(*lua.LTable); ok {
+			pass.ForEach(func(_, v lua.LValue) {
+				if val, ok := os.LookupEnv(LToString(v)); ok {
+					env[LToString(v)] = val
+				}
+			})
+		}
+	} else {
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			env[k] = v
+		}
+	}
+	if overrides, ok := vm.L.GetField(vm.pkg, "env").(*lua.LTable); ok {
+		overrides.ForEach(func(k, v lua.LValue) {
+			if v == lua.LFalse {
+				delete(env, LToString(k))
+			} else {
+				env[LToString(k)] = LToString(v)
+			}
+		})
+	}
+	return env
+}
+
+// Getenv returns the value of the environment variable 'name' that recipes
+// will be run with.
+func (vm *LuaVM) Getenv(name string) (string, bool) {
+	val, ok := vm.environ()[name]
+	return val, ok
+}
+
+// Environ returns the environment that recipes will be run with, as a list of
+// 'key=value' strings.
+func (vm *LuaVM) Environ() []string {
+	return envList(vm.environ())
+}
+
+// Returns the variables of 'env' as a sorted list of 'key=value' strings.
+func envList(env map[string]string) []string {
+	vars := make([]string, 0, len(env))
+	for k, v := range env {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// HasTools returns true if any tools were declared with 'knit.tool'.
+func (vm *LuaVM) HasTools() bool {
+	return len(vm.tools) != 0
+}
+
+// Fingerprint returns a value identifying the version of 'tool', if it was
+// declared with 'knit.tool'. The fingerprint is the output of the tool's version
+// command, or a hash of the tool's binary if no command was given. Both use
+// the environment that recipes run with, so the binary is found in its PATH.
+// It is only computed once per run.
+func (vm *LuaVM) Fingerprint(tool string) (string, bool, error) {
+	version, ok := vm.tools[tool]
+	if !ok {
+		return "", false, nil
+	}
+	if fp, ok := vm.fingerprints[tool]; ok {
+		return fp, true, nil
+	}
+
+	// checks may fingerprint tools while the Knitfile is still running, so
+	// the environment must not be cached
+	env := vm.currentEnviron()
+	var fp string
+	if version != "" {
+		cmd := exec.Command(vm.shell, "-c", version)
+		cmd.Env = envList(env)
+		b, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", version, err)
+		}
+		fp = string(bytes.TrimSpace(b))
+	} else {
+		var err error
+		fp, err = binaryFingerprint(tool, env["PATH"])
+		if err != nil {
+			return "", false, err
+		}
+	}
+	vm.fingerprints[tool] = fp
+	return fp, true, nil
+}
+
+// Returns a hash of the binary for 'tool', which is searched for in the
+// directories of 'pathenv', or "not found" if it is not installed.
+func binaryFingerprint(tool, pathenv string) (string, error) {
+	path, err := lookPath(tool, pathenv)
+	if err != nil {
+		// the tool is not installed, so recipes that use it will be
+		// rebuilt once it is
+		return "not found", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(fnv1a.HashBytes64(data), 16), nil
+}
+
+// Finds the executable 'file' like exec.LookPath, but in the directories of
+// 'pathenv' instead of the PATH of this process.
+func lookPath(file, pathenv string) (string, error) {
+	if filepath.Base(file) != file {
+		return exec.LookPath(file)
+	}
+	for _, dir := range filepath.SplitList(pathenv) {
+		path := filepath.Join(dir, file)
+		if filepath.Base(path) == path {
+			// an empty entry or '.' is the current directory, and the path
+			// must not be searched for in the PATH of this process
+			path = "." + string(filepath.Separator) + path
+		}
+		if path, err := exec.LookPath(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
 // LToString converts a Lua value to a string.
 func LToString(v lua.LValue) string {
 	switch v := v.(type) {